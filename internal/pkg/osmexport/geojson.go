@@ -0,0 +1,62 @@
+package osmexport
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// writeGeoJSON writes the features as a FeatureCollection, or one feature per
+// line with seq, in WGS 84 as GeoJSON requires.
+func writeGeoJSON(src *source, seq bool, db *sql.DB) int {
+	f, err := os.Create(src.c.File)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if !seq {
+		w.WriteString(`{"type":"FeatureCollection","features":[`)
+		w.WriteString("\n")
+	}
+
+	first := true
+	count := src.each(exportSRID, db, func(fid int64, vals []interface{}, geom orb.Geometry) {
+		feature := geojson.NewFeature(geom)
+		feature.ID = fid
+		for i, col := range src.cols {
+			if vals[i] != nil {
+				feature.Properties[col.out] = vals[i]
+			}
+		}
+
+		data, err := json.Marshal(feature)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if !seq && !first {
+			w.WriteString(",\n")
+		}
+		w.Write(data)
+		if seq {
+			w.WriteString("\n")
+		}
+		first = false
+	})
+
+	if !seq {
+		w.WriteString("\n]}\n")
+	}
+	err = w.Flush()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return count
+}
@@ -0,0 +1,312 @@
+package osmexport
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkb"
+	OGM "navinfo.com/osmsqlitetools/internal/pkg/osmgeom"
+)
+
+const (
+	gpkgApplicationID = 0x47504B47
+	gpkgUserVersion   = 10300
+	gpkgGeomCol       = "geom"
+)
+
+// writeGeoPackage writes the layer as a table of the GeoPackage in File, which
+// is created when missing, with its gpkg_contents and gpkg_geometry_columns
+// entries and an RTree spatial index with the triggers of the spec. A layer
+// without geometry is written as an attributes table.
+func writeGeoPackage(src *source, db *sql.DB) int {
+	gpkg, err := sql.Open("sqlite3", src.c.File)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer gpkg.Close()
+	gpkg.SetMaxOpenConns(1)
+
+	initGeoPackage(gpkg)
+
+	srid := src.srid
+	if srid == 0 {
+		srid = exportSRID
+	}
+	tblName := src.c.Layer
+	dropGeoPackageTable(tblName, gpkg)
+	if src.hasGeom {
+		addSpatialRefSys(srid, db, gpkg)
+	}
+
+	strCols := "fid INTEGER PRIMARY KEY AUTOINCREMENT"
+	if src.hasGeom {
+		strCols += fmt.Sprintf(", %s %s", gpkgGeomCol, geometryTypeName(src.c.Layer, db))
+	}
+	cols := []string{}
+	idxs := []int{}
+	for i, col := range src.cols {
+		if col.name == "ogc_fid" {
+			continue
+		}
+		strCols += fmt.Sprintf(`, "%s" %s`, col.out, sqliteType(col.kind))
+		cols = append(cols, fmt.Sprintf(`"%s"`, col.out))
+		idxs = append(idxs, i)
+	}
+	execAll(gpkg, fmt.Sprintf("CREATE TABLE %s (%s)", tblName, strCols))
+
+	tx, err := gpkg.Begin()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	strInsCols := strings.Join(append([]string{"fid"}, cols...), ", ")
+	strVals := strings.TrimSuffix(strings.Repeat("?, ", len(cols)+1), ", ")
+	if src.hasGeom {
+		strInsCols += ", " + gpkgGeomCol
+		strVals += ", ?"
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", tblName, strInsCols, strVals))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var (
+		stmtIdx *sql.Stmt
+		extent  orb.Bound
+		empty   = true
+	)
+	if src.hasGeom {
+		execAll(tx, fmt.Sprintf("CREATE VIRTUAL TABLE rtree_%s_%s USING rtree(id, minx, maxx, miny, maxy)", tblName, gpkgGeomCol))
+		stmtIdx, err = tx.Prepare(fmt.Sprintf("INSERT INTO rtree_%s_%s (id, minx, maxx, miny, maxy) VALUES (?, ?, ?, ?, ?)", tblName, gpkgGeomCol))
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	count := src.each(src.srid, db, func(fid int64, vals []interface{}, geom orb.Geometry) {
+		args := []interface{}{fid}
+		for _, i := range idxs {
+			args = append(args, vals[i])
+		}
+		if src.hasGeom {
+			var data []byte
+			if geom != nil {
+				data = gpkgGeometry(geom, srid)
+			}
+			args = append(args, data)
+		}
+
+		_, err := stmt.Exec(args...)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		if geom == nil || !src.hasGeom {
+			return
+		}
+		b := geom.Bound()
+		_, err = stmtIdx.Exec(fid, b.Min[0], b.Max[0], b.Min[1], b.Max[1])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if empty {
+			extent, empty = b, false
+		} else {
+			extent = extent.Union(b)
+		}
+	})
+	stmt.Close()
+	if stmtIdx != nil {
+		stmtIdx.Close()
+		// The triggers are added after the index is filled, as they need the
+		// ST_* functions of the GeoPackage readers.
+		createRTreeTriggers(tblName, tx)
+	}
+
+	strNow := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	if src.hasGeom {
+		var bound []interface{}
+		if empty {
+			bound = []interface{}{nil, nil, nil, nil}
+		} else {
+			bound = []interface{}{extent.Min[0], extent.Min[1], extent.Max[0], extent.Max[1]}
+		}
+		_, err = tx.Exec("INSERT INTO gpkg_contents (table_name, data_type, identifier, last_change, min_x, min_y, max_x, max_y, srs_id) VALUES (?, 'features', ?, ?, ?, ?, ?, ?, ?)",
+			append(append([]interface{}{tblName, tblName, strNow}, bound...), srid)...)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		_, err = tx.Exec("INSERT INTO gpkg_geometry_columns (table_name, column_name, geometry_type_name, srs_id, z, m) VALUES (?, ?, ?, ?, 0, 0)",
+			tblName, gpkgGeomCol, geometryTypeName(src.c.Layer, db), srid)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		_, err = tx.Exec("INSERT INTO gpkg_extensions (table_name, column_name, extension_name, definition, scope) VALUES (?, ?, 'gpkg_rtree_index', 'http://www.geopackage.org/spec120/#extension_rtree', 'write-only')",
+			tblName, gpkgGeomCol)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	} else {
+		_, err = tx.Exec("INSERT INTO gpkg_contents (table_name, data_type, identifier, last_change) VALUES (?, 'attributes', ?, ?)", tblName, tblName, strNow)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return count
+}
+
+// createRTreeTriggers creates the triggers of the gpkg_rtree_index extension,
+// keeping rtree_<table>_geom up to date when the features are edited.
+func createRTreeTriggers(tblName string, tx execer) {
+	r := fmt.Sprintf("rtree_%s_%s", tblName, gpkgGeomCol)
+	g := gpkgGeomCol
+	strIns := fmt.Sprintf("INSERT OR REPLACE INTO %s VALUES (NEW.fid, ST_MinX(NEW.%s), ST_MaxX(NEW.%s), ST_MinY(NEW.%s), ST_MaxY(NEW.%s))", r, g, g, g, g)
+	strNotEmpty := fmt.Sprintf("(NEW.%s NOTNULL AND NOT ST_IsEmpty(NEW.%s))", g, g)
+	strEmpty := fmt.Sprintf("(NEW.%s ISNULL OR ST_IsEmpty(NEW.%s))", g, g)
+
+	execAll(tx,
+		fmt.Sprintf("CREATE TRIGGER %s_insert AFTER INSERT ON %s WHEN %s BEGIN %s; END", r, tblName, strNotEmpty, strIns),
+		fmt.Sprintf("CREATE TRIGGER %s_update1 AFTER UPDATE OF %s ON %s WHEN OLD.fid = NEW.fid AND %s BEGIN %s; END", r, g, tblName, strNotEmpty, strIns),
+		fmt.Sprintf("CREATE TRIGGER %s_update2 AFTER UPDATE OF %s ON %s WHEN OLD.fid = NEW.fid AND %s BEGIN DELETE FROM %s WHERE id = OLD.fid; END", r, g, tblName, strEmpty, r),
+		fmt.Sprintf("CREATE TRIGGER %s_update3 AFTER UPDATE ON %s WHEN OLD.fid != NEW.fid AND %s BEGIN DELETE FROM %s WHERE id = OLD.fid; %s; END", r, tblName, strNotEmpty, r, strIns),
+		fmt.Sprintf("CREATE TRIGGER %s_update4 AFTER UPDATE ON %s WHEN OLD.fid != NEW.fid AND %s BEGIN DELETE FROM %s WHERE id IN (OLD.fid, NEW.fid); END", r, tblName, strEmpty, r),
+		fmt.Sprintf("CREATE TRIGGER %s_delete AFTER DELETE ON %s WHEN OLD.%s NOT NULL BEGIN DELETE FROM %s WHERE id = OLD.fid; END", r, tblName, g, r),
+	)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func execAll(db execer, strSqls ...string) {
+	for _, strSql := range strSqls {
+		_, err := db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// initGeoPackage creates the GeoPackage tables and the required spatial
+// reference systems, when they do not exist yet.
+func initGeoPackage(gpkg *sql.DB) {
+	execAll(gpkg,
+		fmt.Sprintf("PRAGMA application_id = %d", gpkgApplicationID),
+		fmt.Sprintf("PRAGMA user_version = %d", gpkgUserVersion),
+		`CREATE TABLE IF NOT EXISTS gpkg_spatial_ref_sys (srs_name TEXT NOT NULL, srs_id INTEGER PRIMARY KEY, organization TEXT NOT NULL,
+			organization_coordsys_id INTEGER NOT NULL, definition TEXT NOT NULL, description TEXT)`,
+		`CREATE TABLE IF NOT EXISTS gpkg_contents (table_name TEXT NOT NULL PRIMARY KEY, data_type TEXT NOT NULL, identifier TEXT UNIQUE,
+			description TEXT DEFAULT '', last_change DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+			min_x DOUBLE, min_y DOUBLE, max_x DOUBLE, max_y DOUBLE, srs_id INTEGER,
+			CONSTRAINT fk_gc_r_srs_id FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys(srs_id))`,
+		`CREATE TABLE IF NOT EXISTS gpkg_geometry_columns (table_name TEXT NOT NULL, column_name TEXT NOT NULL, geometry_type_name TEXT NOT NULL,
+			srs_id INTEGER NOT NULL, z TINYINT NOT NULL, m TINYINT NOT NULL,
+			CONSTRAINT pk_geom_cols PRIMARY KEY (table_name, column_name),
+			CONSTRAINT fk_gc_tn FOREIGN KEY (table_name) REFERENCES gpkg_contents(table_name),
+			CONSTRAINT fk_gc_srs FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys (srs_id))`,
+		`CREATE TABLE IF NOT EXISTS gpkg_extensions (table_name TEXT, column_name TEXT, extension_name TEXT NOT NULL,
+			definition TEXT NOT NULL, scope TEXT NOT NULL,
+			CONSTRAINT ge_tce UNIQUE (table_name, column_name, extension_name))`,
+		`INSERT OR IGNORE INTO gpkg_spatial_ref_sys (srs_name, srs_id, organization, organization_coordsys_id, definition) VALUES
+			('Undefined cartesian SRS', -1, 'NONE', -1, 'undefined'),
+			('Undefined geographic SRS', 0, 'NONE', 0, 'undefined'),
+			('WGS 84 geodetic', 4326, 'EPSG', 4326, 'GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]]')`,
+	)
+}
+
+func dropGeoPackageTable(tblName string, gpkg *sql.DB) {
+	execAll(gpkg,
+		fmt.Sprintf("DROP TABLE IF EXISTS rtree_%s_%s", tblName, gpkgGeomCol),
+		fmt.Sprintf("DROP TABLE IF EXISTS %s", tblName),
+		fmt.Sprintf("DELETE FROM gpkg_extensions WHERE table_name = '%s'", tblName),
+		fmt.Sprintf("DELETE FROM gpkg_geometry_columns WHERE table_name = '%s'", tblName),
+		fmt.Sprintf("DELETE FROM gpkg_contents WHERE table_name = '%s'", tblName),
+	)
+}
+
+// addSpatialRefSys copies the definition of srid from spatial_ref_sys of the
+// spatialite database.
+func addSpatialRefSys(srid int, db *sql.DB, gpkg *sql.DB) {
+	var count int
+	err := gpkg.QueryRow("SELECT COUNT(*) FROM gpkg_spatial_ref_sys WHERE srs_id = ?", srid).Scan(&count)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if count > 0 {
+		return
+	}
+
+	var (
+		name, auth string
+		authSRID   int
+		def        string
+	)
+	row := db.QueryRow("SELECT ref_sys_name, auth_name, auth_srid, srtext FROM spatial_ref_sys WHERE srid = ?", srid)
+	err = row.Scan(&name, &auth, &authSRID, &def)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	_, err = gpkg.Exec("INSERT INTO gpkg_spatial_ref_sys (srs_name, srs_id, organization, organization_coordsys_id, definition) VALUES (?, ?, ?, ?, ?)",
+		name, srid, strings.ToUpper(auth), authSRID, def)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// geometryTypeName returns the geometry type of the layer registered in
+// geometry_columns, GEOMETRY when it is not registered.
+func geometryTypeName(tblName string, db *sql.DB) string {
+	if name, ok := OGM.GeometryTypes[OGM.LayerGeometryType(tblName, db)%1000]; ok {
+		return name
+	}
+	return "GEOMETRY"
+}
+
+func sqliteType(kind string) string {
+	kind = strings.ToUpper(kind)
+	switch {
+	case strings.Contains(kind, "INT"):
+		return "INTEGER"
+	case strings.Contains(kind, "REAL"), strings.Contains(kind, "FLOA"), strings.Contains(kind, "DOUB"):
+		return "REAL"
+	default:
+		return "TEXT"
+	}
+}
+
+// gpkgGeometry encodes the geometry as a GeoPackage binary: the GP header with
+// the SRID and the envelope, followed by the WKB.
+func gpkgGeometry(geom orb.Geometry, srid int) []byte {
+	var buf bytes.Buffer
+	// Version 0, little endian with the [minx, maxx, miny, maxy] envelope.
+	buf.Write([]byte{'G', 'P', 0, 0x03})
+	binary.Write(&buf, binary.LittleEndian, int32(srid))
+
+	b := geom.Bound()
+	for _, v := range []float64{b.Min[0], b.Max[0], b.Min[1], b.Max[1]} {
+		binary.Write(&buf, binary.LittleEndian, math.Float64bits(v))
+	}
+
+	data, err := wkb.Marshal(geom, binary.LittleEndian)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	buf.Write(data)
+
+	return buf.Bytes()
+}
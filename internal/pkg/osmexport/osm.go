@@ -0,0 +1,418 @@
+package osmexport
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	OAT "navinfo.com/osmsqlitetools/internal/pkg/osmattr"
+)
+
+const osmGenerator = "gosmt/1.0.0"
+
+// nonTagCols are the columns of the imported layers which are not tags.
+var nonTagCols = map[string]bool{
+	"ogc_fid": true, "osm_id": true, "osm_way_id": true, "z_order": true, "other_tags": true,
+	"osm_version": true, "osm_timestamp": true, "osm_uid": true, "osm_user": true, "osm_changeset": true,
+}
+
+type osmTag struct {
+	Key   string `xml:"k,attr"`
+	Value string `xml:"v,attr"`
+}
+
+type osmNd struct {
+	Ref int64 `xml:"ref,attr"`
+}
+
+type osmMember struct {
+	Type string `xml:"type,attr"`
+	Ref  int64  `xml:"ref,attr"`
+	Role string `xml:"role,attr"`
+}
+
+// osmElement is a node, way or relation of OSM XML, Action marking the
+// modified elements of a JOSM file.
+type osmElement struct {
+	XMLName xml.Name
+	ID      int64       `xml:"id,attr"`
+	Action  string      `xml:"action,attr,omitempty"`
+	Version int64       `xml:"version,attr,omitempty"`
+	Lat     string      `xml:"lat,attr,omitempty"`
+	Lon     string      `xml:"lon,attr,omitempty"`
+	Nds     []osmNd     `xml:"nd"`
+	Members []osmMember `xml:"member"`
+	Tags    []osmTag    `xml:"tag"`
+}
+
+// writeOSM writes the features of an imported layer whose typed tag columns,
+// in the Joins tables, were edited, as OSM XML for JOSM or as the modify of an
+// osmChange. The elements keep their osm_id and version, their tags being the
+// ones of the layer columns and other_tags with the edits applied. The ways
+// take their nodes from way_nodes and the relations their members from
+// relation_members. The segments of a split way share its osm_id, the element
+// is written once and their edits must agree. The nodes of the ways are only
+// referenced, not written: an osmChange does not need them, and the .osm file
+// is to be merged into the data of the area downloaded in JOSM. An osmChange
+// modify needs the version of each element.
+func writeOSM(src *source, change bool, db *sql.DB) int {
+	c := src.c
+	if len(c.Fields) > 0 {
+		log.Fatalf("Fields cannot be selected for %s, the elements are written with all their tags", c.File)
+	}
+	names := tagNames(c)
+
+	var wayStmt, memberStmt *sql.Stmt
+	if OAT.IsTblExist("way_nodes", db) {
+		wayStmt = prepare("SELECT node_id FROM way_nodes WHERE way_id = ? ORDER BY seq", db)
+		defer wayStmt.Close()
+	}
+	if OAT.IsTblExist("relation_members", db) {
+		memberStmt = prepare("SELECT member_type, member_id, role FROM relation_members WHERE relation_id = ? ORDER BY seq", db)
+		defer memberStmt.Close()
+	}
+
+	f, err := os.Create(c.File)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	w.WriteString(xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+
+	starts := []xml.StartElement{{
+		Name: xml.Name{Local: "osm"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "version"}, Value: "0.6"}, {Name: xml.Name{Local: "generator"}, Value: osmGenerator}},
+	}}
+	action := "modify"
+	if change {
+		starts[0].Name.Local = "osmChange"
+		starts = append(starts, xml.StartElement{Name: xml.Name{Local: "modify"}})
+		action = ""
+	}
+	for _, start := range starts {
+		if err := enc.EncodeToken(start); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	idx := map[string]int{}
+	for i, col := range src.cols {
+		if col.table == c.Layer {
+			idx[col.name] = i
+		}
+	}
+
+	count := 0
+	written := map[string]uint64{}
+	src.each(exportSRID, db, func(fid int64, vals []interface{}, geom orb.Geometry) {
+		e := osmElement{XMLName: xml.Name{Local: "relation"}, ID: intValue(vals, idx, "osm_id"), Action: action}
+		if wayID := intValue(vals, idx, "osm_way_id"); wayID != 0 {
+			e.XMLName.Local, e.ID = "way", wayID
+		}
+		switch geom.(type) {
+		case orb.Point:
+			e.XMLName.Local = "node"
+		case orb.LineString:
+			e.XMLName.Local = "way"
+		}
+		if e.ID == 0 {
+			log.Fatalf("Feature %d of %s has no osm_id", fid, c.Layer)
+		}
+
+		tags, edited := editedTags(src, vals, names)
+		key := e.XMLName.Local + " " + strconv.FormatInt(e.ID, 10)
+		sum := tagsSum(tags)
+		if prev, ok := written[key]; ok {
+			if prev != sum {
+				log.Fatalf("The features of %s %d in %s have different edits", e.XMLName.Local, e.ID, c.Layer)
+			}
+			return
+		}
+		written[key] = sum
+		if !edited {
+			return
+		}
+		e.Tags = tags
+		e.Version = intValue(vals, idx, "osm_version")
+		if change && e.Version == 0 {
+			log.Fatalf("%s %d in %s has no osm_version, import with writeback to write an osmChange", e.XMLName.Local, e.ID, c.Layer)
+		}
+
+		switch e.XMLName.Local {
+		case "node":
+			p := geom.(orb.Point)
+			e.Lat = strconv.FormatFloat(p.Lat(), 'f', -1, 64)
+			e.Lon = strconv.FormatFloat(p.Lon(), 'f', -1, 64)
+		case "way":
+			if wayStmt == nil {
+				log.Fatalf("way_nodes does not exist, import with writeback to write the ways of %s", c.Layer)
+			}
+			e.Nds = wayNodes(e.ID, wayStmt)
+			if len(e.Nds) == 0 {
+				log.Fatalf("Way %d is not in way_nodes", e.ID)
+			}
+		case "relation":
+			if memberStmt == nil {
+				log.Fatalf("relation_members does not exist, import with the tools to write the relations of %s", c.Layer)
+			}
+			e.Members = relationMembers(e.ID, memberStmt)
+		}
+
+		if err := enc.Encode(e); err != nil {
+			log.Fatalln(err)
+		}
+		count++
+	})
+
+	for i := len(starts) - 1; i >= 0; i-- {
+		if err := enc.EncodeToken(starts[i].End()); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		log.Fatalln(err)
+	}
+	w.WriteString("\n")
+	err = w.Flush()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return count
+}
+
+// tagNames maps the fields of the Joins tables to their tag names, e.g.
+// lines_tags.name_en to name:en, from the tag extract config TagsConfig.
+func tagNames(c ExportConfig) map[string]string {
+	names := map[string]string{}
+	if len(c.TagsConfig) == 0 {
+		return names
+	}
+
+	for _, tc := range OAT.LoadTagConfigs(c.TagsConfig).Configs {
+		if !slices.Contains(c.Joins, tc.Ref) {
+			continue
+		}
+		for _, t := range tc.Tags {
+			names[tc.Ref+"."+t.Field] = t.Name
+		}
+	}
+	return names
+}
+
+// editedTags returns the tags of a feature, the ones of the layer columns and
+// other_tags with the typed tag columns of the Joins applied, and whether the
+// typed columns changed any of them. A column still holding the value
+// ExtractTags stored for the tag leaves it as it is, and so does a Joins
+// table without a row for the feature, all its columns being NULL.
+func editedTags(src *source, vals []interface{}, names map[string]string) ([]osmTag, bool) {
+	tags := map[string]string{}
+	joined := map[string]bool{}
+	for i, col := range src.cols {
+		switch {
+		case col.table != src.c.Layer:
+			joined[col.table] = joined[col.table] || vals[i] != nil
+		case vals[i] == nil:
+		case col.name == "other_tags":
+			maps.Copy(tags, OAT.ParseTags(fmt.Sprint(vals[i])))
+		case !nonTagCols[col.name]:
+			tags[col.name] = fmt.Sprint(vals[i])
+		}
+	}
+
+	orig := maps.Clone(tags)
+	for i, col := range src.cols {
+		if col.table == src.c.Layer || !joined[col.table] {
+			continue
+		}
+		name, ok := names[col.table+"."+col.name]
+		if !ok {
+			name = col.name
+		}
+		v, ok := orig[name]
+		switch {
+		case vals[i] == nil:
+			delete(tags, name)
+		case ok && storedValue(v, col.kind) == sqliteValue(vals[i]):
+		default:
+			tags[name] = tagValue(vals[i], col.kind)
+		}
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	osmTags := make([]osmTag, len(keys))
+	for i, k := range keys {
+		osmTags[i] = osmTag{Key: k, Value: tags[k]}
+	}
+	return osmTags, !maps.Equal(orig, tags)
+}
+
+// sqliteValue returns the value as SQLite stores it, the driver reading the
+// integers of a BOOLEAN column as bool.
+func sqliteValue(v interface{}) interface{} {
+	if b, ok := v.(bool); ok {
+		if b {
+			return int64(1)
+		}
+		return int64(0)
+	}
+	return v
+}
+
+// tagsSum hashes the sorted tags, to compare the features of an element
+// without keeping their tags.
+func tagsSum(tags []osmTag) uint64 {
+	h := fnv.New64a()
+	for _, t := range tags {
+		h.Write([]byte(t.Key))
+		h.Write([]byte{0})
+		h.Write([]byte(t.Value))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+var numericText = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][+-]?[0-9]+)?$`)
+
+// storedValue returns the value SQLite stores for the tag value s in a column
+// of type kind, following the type affinity of the column: a well-formed
+// number becomes an int64 or a float64 in an INTEGER, REAL or NUMERIC column,
+// e.g. 50.0 in a BOOL or INTEGER column being stored as 50.
+func storedValue(s string, kind string) interface{} {
+	kind = strings.ToUpper(kind)
+	switch {
+	case strings.Contains(kind, "INT"):
+	case strings.Contains(kind, "CHAR"), strings.Contains(kind, "CLOB"), strings.Contains(kind, "TEXT"),
+		strings.Contains(kind, "BLOB"), kind == "":
+		return s
+	}
+
+	t := strings.TrimSpace(s)
+	if !numericText.MatchString(t) {
+		return s
+	}
+	isReal := strings.Contains(kind, "REAL") || strings.Contains(kind, "FLOA") || strings.Contains(kind, "DOUB")
+	if !isReal {
+		if i, err := strconv.ParseInt(t, 10, 64); err == nil {
+			return i
+		}
+	}
+	f, err := strconv.ParseFloat(t, 64)
+	if err != nil {
+		return s
+	}
+	if !isReal && f == float64(int64(f)) && f > -9.2e18 && f < 9.2e18 {
+		return int64(f)
+	}
+	return f
+}
+
+// tagValue formats the value of a typed tag column as a tag value, a boolean
+// set to 1 or 0 becoming yes or no.
+func tagValue(v interface{}, kind string) string {
+	isBool := strings.HasPrefix(strings.ToUpper(kind), "BOOL")
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return "yes"
+		}
+		return "no"
+	case int64:
+		if isBool && v == 1 {
+			return "yes"
+		}
+		if isBool && v == 0 {
+			return "no"
+		}
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// intValue returns the integer value of the column, 0 when it is missing or NULL.
+func intValue(vals []interface{}, idx map[string]int, name string) int64 {
+	i, ok := idx[name]
+	if !ok || vals[i] == nil {
+		return 0
+	}
+
+	id, err := strconv.ParseInt(fmt.Sprint(vals[i]), 10, 64)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return id
+}
+
+func wayNodes(id int64, stmt *sql.Stmt) []osmNd {
+	rows, err := stmt.Query(id)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	nds := []osmNd{}
+	for rows.Next() {
+		var nd osmNd
+		if err := rows.Scan(&nd.Ref); err != nil {
+			log.Fatalln(err)
+		}
+		nds = append(nds, nd)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	return nds
+}
+
+func relationMembers(id int64, stmt *sql.Stmt) []osmMember {
+	rows, err := stmt.Query(id)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	members := []osmMember{}
+	for rows.Next() {
+		var m osmMember
+		if err := rows.Scan(&m.Type, &m.Ref, &m.Role); err != nil {
+			log.Fatalln(err)
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	return members
+}
+
+func prepare(strSql string, db *sql.DB) *sql.Stmt {
+	stmt, err := db.Prepare(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return stmt
+}
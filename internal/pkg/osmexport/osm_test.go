@@ -0,0 +1,123 @@
+package osmexport
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEditedTags(t *testing.T) {
+	src := &source{
+		c: ExportConfig{Layer: "lines", Joins: []string{"lines_tags"}},
+		cols: []column{
+			{table: "lines", name: "osm_id", kind: "VARCHAR"},
+			{table: "lines", name: "highway", kind: "VARCHAR"},
+			{table: "lines", name: "other_tags", kind: "VARCHAR"},
+			{table: "lines_tags", name: "lanes", kind: "INTEGER"},
+			{table: "lines_tags", name: "oneway", kind: "BOOLEAN"},
+			{table: "lines_tags", name: "name_en", kind: "VARCHAR"},
+		},
+	}
+	names := map[string]string{"lines_tags.name_en": "name:en"}
+	otherTags := `"lanes"=>"50.0","oneway"=>"yes","name:en"=>"Main Street"`
+
+	tests := []struct {
+		name   string
+		joined []interface{}
+		want   []osmTag
+		edited bool
+	}{
+		{
+			name:   "stored values",
+			joined: []interface{}{int64(50), "yes", "Main Street"},
+			want:   []osmTag{{"highway", "primary"}, {"lanes", "50.0"}, {"name:en", "Main Street"}, {"oneway", "yes"}},
+		},
+		{
+			name:   "edited number",
+			joined: []interface{}{int64(2), "yes", "Main Street"},
+			want:   []osmTag{{"highway", "primary"}, {"lanes", "2"}, {"name:en", "Main Street"}, {"oneway", "yes"}},
+			edited: true,
+		},
+		{
+			name:   "edited boolean",
+			joined: []interface{}{int64(50), false, "Main Street"},
+			want:   []osmTag{{"highway", "primary"}, {"lanes", "50.0"}, {"name:en", "Main Street"}, {"oneway", "no"}},
+			edited: true,
+		},
+		{
+			name:   "removed tag",
+			joined: []interface{}{int64(50), "yes", nil},
+			want:   []osmTag{{"highway", "primary"}, {"lanes", "50.0"}, {"oneway", "yes"}},
+			edited: true,
+		},
+		{
+			name:   "no row in the join",
+			joined: []interface{}{nil, nil, nil},
+			want:   []osmTag{{"highway", "primary"}, {"lanes", "50.0"}, {"name:en", "Main Street"}, {"oneway", "yes"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vals := append([]interface{}{"10", "primary", otherTags}, tt.joined...)
+			got, edited := editedTags(src, vals, names)
+			if !reflect.DeepEqual(got, tt.want) || edited != tt.edited {
+				t.Errorf("editedTags() = %v, %v, want %v, %v", got, edited, tt.want, tt.edited)
+			}
+		})
+	}
+}
+
+func TestStoredValue(t *testing.T) {
+	tests := []struct {
+		s    string
+		kind string
+		want interface{}
+	}{
+		{"50", "INTEGER", int64(50)},
+		{"50.0", "INTEGER", int64(50)},
+		{"50.5", "INTEGER", 50.5},
+		{"2;3", "INTEGER", "2;3"},
+		{"3.50", "REAL", 3.5},
+		{"4", "REAL", 4.0},
+		{"1.0", "BOOLEAN", int64(1)},
+		{"yes", "BOOLEAN", "yes"},
+		{"50.0", "VARCHAR", "50.0"},
+		{"50.0", "", "50.0"},
+		{" 7 ", "NUMERIC", int64(7)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.kind+" "+tt.s, func(t *testing.T) {
+			if got := storedValue(tt.s, tt.kind); got != tt.want {
+				t.Errorf("storedValue(%q, %q) = %#v, want %#v", tt.s, tt.kind, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagValue(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		kind string
+		want string
+	}{
+		{"bool true", true, "BOOLEAN", "yes"},
+		{"bool false", false, "BOOLEAN", "no"},
+		{"boolean 1", int64(1), "BOOLEAN", "yes"},
+		{"boolean 0", int64(0), "BOOLEAN", "no"},
+		{"boolean 2", int64(2), "BOOLEAN", "2"},
+		{"integer 1", int64(1), "INTEGER", "1"},
+		{"real", 3.5, "REAL", "3.5"},
+		{"whole real", 4.0, "REAL", "4"},
+		{"text", "2;3", "VARCHAR", "2;3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tagValue(tt.v, tt.kind); got != tt.want {
+				t.Errorf("tagValue() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package osmexport
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkb"
+	"gopkg.in/yaml.v3"
+	OGM "navinfo.com/osmsqlitetools/internal/pkg/osmgeom"
+)
+
+const exportSRID = 4326
+
+type ExportConfigs struct {
+	Configs []ExportConfig
+}
+
+// ExportConfig writes Layer, joined by osm_id to the Joins tables (e.g. the
+// tag tables), to File in Format. Fields selects the columns, all of them by
+// default, and Bbox (min lon, min lat, max lon, max lat) the features. For
+// csv and parquet, Geometry is "wkt", "wkb" or empty to leave the geometry
+// out, and Partition the column splitting the rows into one file per value.
+// For osm and osc, TagsConfig is the tag extract config of the Joins, mapping
+// their fields back to the tag names.
+type ExportConfig struct {
+	Layer      string
+	Joins      []string
+	Fields     []string
+	Bbox       []float64
+	File       string
+	Format     string
+	Geometry   string
+	Partition  string
+	TagsConfig string
+}
+
+// column of the layer or of a Joins table, out being its name in the output,
+// prefixed with the table of a joined column which collides with another one.
+type column struct {
+	table string
+	name  string
+	kind  string
+	out   string
+}
+
+// source reads the features of a layer with the selected columns.
+type source struct {
+	c       ExportConfig
+	cols    []column
+	hasGeom bool
+	srid    int
+}
+
+func loadExportConfigs(filename string) ExportConfigs {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var conf ExportConfigs
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return conf
+}
+
+// Export writes the layers of the export config, streaming the features so a
+// layer does not need to fit in memory.
+func Export(strConfigFileName string, db *sql.DB) {
+	conf := loadExportConfigs(strConfigFileName)
+	written := map[string]bool{}
+	for _, c := range conf.Configs {
+		log.Printf("Start export %s to %s", c.Layer, c.File)
+
+		src := newSource(c, db)
+		var count int
+		switch format := c.format(); format {
+		case "geojson", "geojsonseq":
+			count = writeGeoJSON(src, format == "geojsonseq", db)
+		case "gpkg":
+			count = writeGeoPackage(src, db)
+		case "postgis":
+			count = writePostGIS(src, written[c.File], db)
+		case "csv", "parquet":
+			count = writeTable(src, format, db)
+		case "osm", "osc":
+			count = writeOSM(src, format == "osc", db)
+		default:
+			log.Fatalf("Unknown export format %s", format)
+		}
+
+		written[c.File] = true
+		log.Printf("Finished export %s to %s, %d features", c.Layer, c.File, count)
+	}
+}
+
+// format returns Format, or guesses it from the extension of File.
+func (c ExportConfig) format() string {
+	if len(c.Format) > 0 {
+		return c.Format
+	}
+
+	switch {
+	case strings.HasSuffix(c.File, ".geojsonl"), strings.HasSuffix(c.File, ".geojsons"), strings.HasSuffix(c.File, ".geojsonseq"):
+		return "geojsonseq"
+	case strings.HasSuffix(c.File, ".gpkg"):
+		return "gpkg"
+	case strings.HasSuffix(c.File, ".sql"):
+		return "postgis"
+	case strings.HasSuffix(c.File, ".csv"):
+		return "csv"
+	case strings.HasSuffix(c.File, ".parquet"):
+		return "parquet"
+	case strings.HasSuffix(c.File, ".osm"):
+		return "osm"
+	case strings.HasSuffix(c.File, ".osc"):
+		return "osc"
+	default:
+		return "geojson"
+	}
+}
+
+func newSource(c ExportConfig, db *sql.DB) *source {
+	src := &source{c: c, srid: OGM.LayerSRID(c.Layer, db)}
+
+	cols := []column{}
+	for _, col := range tableColumns(c.Layer, db) {
+		if strings.EqualFold(col.name, "GEOMETRY") {
+			src.hasGeom = true
+			continue
+		}
+		cols = append(cols, col)
+	}
+	isOut := func(name string) bool {
+		return slices.ContainsFunc(cols, func(col column) bool { return strings.EqualFold(col.out, name) })
+	}
+	for _, tbl := range c.Joins {
+		for _, col := range tableColumns(tbl, db) {
+			if col.name == "ogc_fid" || col.name == "osm_id" || strings.EqualFold(col.name, "GEOMETRY") {
+				continue
+			}
+			if isOut(col.out) {
+				col.out = tbl + "_" + col.name
+				if isOut(col.out) {
+					log.Fatalf("Column %s of %s collides with %s", col.name, tbl, col.out)
+				}
+			}
+			cols = append(cols, col)
+		}
+	}
+
+	if len(c.Fields) == 0 {
+		src.cols = cols
+		return src
+	}
+	// A field is the output name of a column, or table.column.
+	for _, f := range c.Fields {
+		i := slices.IndexFunc(cols, func(col column) bool { return col.out == f || col.table+"."+col.name == f })
+		if i < 0 {
+			log.Fatalf("Field %s is not in %s", f, c.Layer)
+		}
+		src.cols = append(src.cols, cols[i])
+	}
+	return src
+}
+
+func tableColumns(tblName string, db *sql.DB) []column {
+	rows, err := db.Query("SELECT name, type FROM pragma_table_info(?)", tblName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	cols := []column{}
+	for rows.Next() {
+		col := column{table: tblName}
+		if err := rows.Scan(&col.name, &col.kind); err != nil {
+			log.Fatalln(err)
+		}
+		col.out = col.name
+		cols = append(cols, col)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+	if len(cols) == 0 {
+		log.Fatalf("Table %s does not exist", tblName)
+	}
+
+	return cols
+}
+
+func hasSpatialIndex(tblName string, db *sql.DB) bool {
+	var enabled int
+	row := db.QueryRow("SELECT spatial_index_enabled FROM geometry_columns WHERE lower(f_table_name) = lower(?) AND lower(f_geometry_column) = 'geometry'", tblName)
+	err := row.Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return enabled == 1
+}
+
+// query builds the select of the features in srid, the ogc_fid first and the
+// geometry last.
+func (src *source) query(srid int, db *sql.DB) string {
+	strCols := "t.ogc_fid"
+	for _, col := range src.cols {
+		strCols += fmt.Sprintf(`, "%s"."%s"`, src.alias(col.table), col.name)
+	}
+
+	strGeom := "NULL"
+	if src.hasGeom {
+		strGeom = "t.GEOMETRY"
+		if src.srid != 0 && srid != 0 && src.srid != srid {
+			strGeom = fmt.Sprintf("ST_Transform(t.GEOMETRY, %d)", srid)
+		}
+		strGeom = fmt.Sprintf("ST_AsBinary(%s)", strGeom)
+	}
+	strCols += ", " + strGeom
+
+	strSql := fmt.Sprintf("SELECT %s FROM %s AS t", strCols, src.c.Layer)
+	for i, tbl := range src.c.Joins {
+		strSql += fmt.Sprintf(" LEFT JOIN %s AS j%d ON j%d.osm_id = t.osm_id", tbl, i, i)
+	}
+
+	if len(src.c.Bbox) == 4 && src.hasGeom {
+		b := src.c.Bbox
+		strMbr := fmt.Sprintf("BuildMbr(%f, %f, %f, %f, %d)", b[0], b[1], b[2], b[3], exportSRID)
+		if src.srid != 0 && src.srid != exportSRID {
+			strMbr = fmt.Sprintf("ST_Transform(%s, %d)", strMbr, src.srid)
+		}
+		strSql += fmt.Sprintf(" WHERE MbrIntersects(t.GEOMETRY, %s)", strMbr)
+		if hasSpatialIndex(src.c.Layer, db) {
+			strSql += fmt.Sprintf(" AND t.ogc_fid IN (SELECT rowid FROM SpatialIndex WHERE f_table_name = '%s' AND f_geometry_column = 'GEOMETRY' AND search_frame = %s)", src.c.Layer, strMbr)
+		}
+	}
+
+	return strSql + " ORDER BY t.ogc_fid"
+}
+
+func (src *source) alias(tblName string) string {
+	if i := slices.Index(src.c.Joins, tblName); i >= 0 {
+		return fmt.Sprintf("j%d", i)
+	}
+	return "t"
+}
+
+// each calls fn with the ogc_fid, the values of the columns and the geometry of
+// every feature, the geometry being nil when it is NULL.
+func (src *source) each(srid int, db *sql.DB, fn func(fid int64, vals []interface{}, geom orb.Geometry)) int {
+	rows, err := db.Query(src.query(srid, db))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	var (
+		fid      int64
+		geomData []byte
+		count    int
+	)
+	vals := make([]interface{}, len(src.cols))
+	dest := make([]interface{}, 0, len(src.cols)+2)
+	dest = append(dest, &fid)
+	for i := range vals {
+		dest = append(dest, &vals[i])
+	}
+	dest = append(dest, &geomData)
+
+	for rows.Next() {
+		geomData = nil
+		if err := rows.Scan(dest...); err != nil {
+			log.Fatalln(err)
+		}
+		for i, v := range vals {
+			if b, ok := v.([]byte); ok {
+				vals[i] = string(b)
+			}
+		}
+
+		var geom orb.Geometry
+		if len(geomData) > 0 {
+			geom, err = wkb.Unmarshal(geomData)
+			if err != nil {
+				log.Fatalln(err)
+			}
+		}
+
+		fn(fid, vals, geom)
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	return count
+}
@@ -0,0 +1,174 @@
+package osmexport
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/ewkb"
+)
+
+var postgisTypes = map[string]string{
+	"POINT":              "Point",
+	"LINESTRING":         "LineString",
+	"POLYGON":            "Polygon",
+	"MULTIPOINT":         "MultiPoint",
+	"MULTILINESTRING":    "MultiLineString",
+	"MULTIPOLYGON":       "MultiPolygon",
+	"GEOMETRYCOLLECTION": "GeometryCollection",
+	"GEOMETRY":           "Geometry",
+}
+
+// writePostGIS writes the layer as a PostgreSQL dump loading it with COPY, the
+// geometry in EWKB hex, followed by the GIST index of the geometry and the
+// indexes of osm_id and the *_fid references. With appendFile the dump is
+// added to the file written by a previous config.
+func writePostGIS(src *source, appendFile bool, db *sql.DB) int {
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appendFile {
+		flag = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(src.c.File, flag, 0644)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+
+	srid := src.srid
+	if srid == 0 {
+		srid = exportSRID
+	}
+	tblName := src.c.Layer
+
+	strCols := []string{}
+	strDefs := []string{}
+	strTypes := make([]string, len(src.cols))
+	for i, col := range src.cols {
+		strType := postgresType(col.kind)
+		strTypes[i] = strType
+		if col.name == "ogc_fid" {
+			continue
+		}
+		strCols = append(strCols, fmt.Sprintf(`"%s"`, col.out))
+		strDefs = append(strDefs, fmt.Sprintf(`"%s" %s`, col.out, strType))
+	}
+	strCols = append([]string{"ogc_fid"}, strCols...)
+	strDefs = append([]string{"ogc_fid bigint PRIMARY KEY"}, strDefs...)
+	if src.hasGeom {
+		strCols = append(strCols, "geom")
+		strDefs = append(strDefs, fmt.Sprintf("geom geometry(%s,%d)", postgisTypes[geometryTypeName(tblName, db)], srid))
+	}
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "BEGIN;\n\n")
+	fmt.Fprintf(w, "DROP TABLE IF EXISTS \"%s\";\n", tblName)
+	fmt.Fprintf(w, "CREATE TABLE \"%s\" (\n\t%s\n);\n\n", tblName, strings.Join(strDefs, ",\n\t"))
+	fmt.Fprintf(w, "COPY \"%s\" (%s) FROM stdin;\n", tblName, strings.Join(strCols, ", "))
+
+	// SQLite keeps a text in an INTEGER or REAL column, e.g. lanes=2;3 in a
+	// tag table, which would fail the COPY, so it is written as NULL.
+	invalid := make([]int, len(src.cols))
+	count := src.each(src.srid, db, func(fid int64, vals []interface{}, geom orb.Geometry) {
+		fields := []string{fmt.Sprint(fid)}
+		for i, col := range src.cols {
+			if col.name == "ogc_fid" {
+				continue
+			}
+			strVal, ok := copyValue(vals[i], strTypes[i])
+			if !ok {
+				invalid[i]++
+			}
+			fields = append(fields, strVal)
+		}
+		if src.hasGeom {
+			if geom == nil {
+				fields = append(fields, `\N`)
+			} else {
+				strHex, err := ewkb.MarshalToHex(geom, srid)
+				if err != nil {
+					log.Fatalln(err)
+				}
+				fields = append(fields, strings.ToUpper(strHex))
+			}
+		}
+		w.WriteString(strings.Join(fields, "\t"))
+		w.WriteString("\n")
+	})
+	fmt.Fprintf(w, "\\.\n\n")
+	for i, n := range invalid {
+		if n > 0 {
+			log.Printf("%d values of %s.%s are not %s, written as NULL", n, src.cols[i].table, src.cols[i].name, strTypes[i])
+		}
+	}
+
+	if src.hasGeom {
+		fmt.Fprintf(w, "CREATE INDEX \"idx_%s_geom\" ON \"%s\" USING GIST (geom);\n", tblName, tblName)
+	}
+	for _, col := range src.cols {
+		if col.out == "osm_id" || (col.out != "ogc_fid" && strings.HasSuffix(col.out, "_fid")) {
+			fmt.Fprintf(w, "CREATE INDEX \"idx_%s_%s\" ON \"%s\" (\"%s\");\n", tblName, col.out, tblName, col.out)
+		}
+	}
+	fmt.Fprintf(w, "ANALYZE \"%s\";\n\nCOMMIT;\n\n", tblName)
+
+	err = w.Flush()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return count
+}
+
+func postgresType(kind string) string {
+	switch sqliteType(kind) {
+	case "INTEGER":
+		return "bigint"
+	case "REAL":
+		return "double precision"
+	default:
+		return "text"
+	}
+}
+
+// copyValue formats a value for the text format of COPY in a column of
+// strType, false when it is not a number of a numeric column and is written as
+// NULL.
+func copyValue(v interface{}, strType string) (string, bool) {
+	if v == nil {
+		return `\N`, true
+	}
+
+	switch strType {
+	case "bigint":
+		switch v := v.(type) {
+		case int64:
+			return strconv.FormatInt(v, 10), true
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+				return strconv.FormatInt(int64(v), 10), true
+			}
+			return `\N`, false
+		default:
+			if _, err := strconv.ParseInt(fmt.Sprint(v), 10, 64); err != nil {
+				return `\N`, false
+			}
+		}
+	case "double precision":
+		switch v.(type) {
+		case int64, float64:
+		default:
+			if _, err := strconv.ParseFloat(fmt.Sprint(v), 64); err != nil {
+				return `\N`, false
+			}
+		}
+	}
+
+	s := fmt.Sprint(v)
+	return strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`).Replace(s), true
+}
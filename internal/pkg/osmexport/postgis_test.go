@@ -0,0 +1,109 @@
+package osmexport
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	// The geometries are stored as WKB, so ST_AsBinary returns them as they are
+	// and the export runs without spatialite.
+	sql.Register("sqlite3_postgis_test", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("ST_AsBinary", func(b []byte) []byte { return b }, true)
+		},
+	})
+}
+
+func TestWritePostGIS(t *testing.T) {
+	db, err := sql.Open("sqlite3_postgis_test", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// LINESTRING(0 0, 1 1) and LINESTRING(1 1, 2 0) as WKB.
+	line1 := "010200000002000000" + "0000000000000000" + "0000000000000000" + "000000000000F03F" + "000000000000F03F"
+	line2 := "010200000002000000" + "000000000000F03F" + "000000000000F03F" + "0000000000000040" + "0000000000000000"
+	execAll(db,
+		"CREATE TABLE geometry_columns (f_table_name TEXT, f_geometry_column TEXT, geometry_type INTEGER, srid INTEGER, spatial_index_enabled INTEGER)",
+		"INSERT INTO geometry_columns VALUES ('lines', 'GEOMETRY', 2, 4326, 0)",
+		"CREATE TABLE lines (ogc_fid INTEGER PRIMARY KEY, osm_id VARCHAR, highway VARCHAR, GEOMETRY BLOB)",
+		"INSERT INTO lines VALUES (1, '10', 'primary', X'"+line1+"')",
+		"INSERT INTO lines VALUES (2, '11', 'resi\tdential', X'"+line2+"')",
+		"CREATE TABLE lines_tags (ogc_fid INTEGER PRIMARY KEY, osm_id VARCHAR, lanes INTEGER, width REAL)",
+		"INSERT INTO lines_tags VALUES (1, '10', 2, 3.5)",
+		"INSERT INTO lines_tags VALUES (2, '11', '2;3', '4')",
+	)
+
+	file := filepath.Join(t.TempDir(), "lines.sql")
+	src := newSource(ExportConfig{Layer: "lines", Joins: []string{"lines_tags"}, File: file}, db)
+	if count := writePostGIS(src, false, db); count != 2 {
+		t.Errorf("writePostGIS() = %d features, want 2", count)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `BEGIN;
+
+DROP TABLE IF EXISTS "lines";
+CREATE TABLE "lines" (
+	ogc_fid bigint PRIMARY KEY,
+	"osm_id" text,
+	"highway" text,
+	"lanes" bigint,
+	"width" double precision,
+	geom geometry(LineString,4326)
+);
+
+COPY "lines" (ogc_fid, "osm_id", "highway", "lanes", "width", geom) FROM stdin;
+1	10	primary	2	3.5	0102000020E610000002000000` + line1[18:] + `
+2	11	resi\tdential	\N	4	0102000020E610000002000000` + line2[18:] + `
+\.
+
+CREATE INDEX "idx_lines_geom" ON "lines" USING GIST (geom);
+CREATE INDEX "idx_lines_osm_id" ON "lines" ("osm_id");
+ANALYZE "lines";
+
+COMMIT;
+
+`
+	if string(data) != want {
+		t.Errorf("writePostGIS() wrote\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestCopyValue(t *testing.T) {
+	tests := []struct {
+		v       interface{}
+		strType string
+		want    string
+		ok      bool
+	}{
+		{nil, "bigint", `\N`, true},
+		{int64(2), "bigint", "2", true},
+		{"2", "bigint", "2", true},
+		{float64(3), "bigint", "3", true},
+		{3.5, "bigint", `\N`, false},
+		{"2;3", "bigint", `\N`, false},
+		{int64(2), "double precision", "2", true},
+		{"4.5", "double precision", "4.5", true},
+		{"wide", "double precision", `\N`, false},
+		{"a\tb\\c\n", "text", `a\tb\\c\n`, true},
+	}
+
+	for _, tt := range tests {
+		got, ok := copyValue(tt.v, tt.strType)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("copyValue(%#v, %s) = %q, %v, want %q, %v", tt.v, tt.strType, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package osmexport
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkb"
+	"github.com/paulmach/orb/encoding/wkt"
+)
+
+const (
+	geometryField     = "geometry"
+	defaultPartition  = "__HIVE_DEFAULT_PARTITION__"
+	partitionFileName = "part-0"
+)
+
+// tableWriter writes the rows of one file, the values in the order of the
+// columns of the source, with the geometry last when it is exported.
+type tableWriter interface {
+	write(vals []interface{})
+	close()
+}
+
+// tableColumn is a column of the exported file and its index in the values of
+// the source, -1 for the geometry.
+type tableColumn struct {
+	name string
+	kind string
+	idx  int
+}
+
+// writeTable writes the attributes of the layer as CSV or Parquet, with the
+// geometry as WKT or WKB when Geometry is set. With Partition the rows are
+// written to one file per value of the column, in Hive style directories
+// <file>/<partition>=<value>/ without the partition column.
+func writeTable(src *source, format string, db *sql.DB) int {
+	c := src.c
+	partIdx := -1
+	if len(c.Partition) > 0 {
+		partIdx = slices.IndexFunc(src.cols, func(col column) bool { return col.out == c.Partition })
+		if partIdx < 0 {
+			log.Fatalf("Partition %s is not a field of %s", c.Partition, c.Layer)
+		}
+	}
+
+	cols := []tableColumn{}
+	for i, col := range src.cols {
+		if i != partIdx {
+			cols = append(cols, tableColumn{name: col.out, kind: tableType(col.kind), idx: i})
+		}
+	}
+	switch c.Geometry {
+	case "":
+	case "wkt":
+		cols = append(cols, tableColumn{name: geometryField, kind: "TEXT", idx: -1})
+	case "wkb":
+		cols = append(cols, tableColumn{name: geometryField, kind: "BLOB", idx: -1})
+	default:
+		log.Fatalf("Unknown geometry encoding %s", c.Geometry)
+	}
+
+	srid := src.srid
+	if srid == 0 {
+		srid = exportSRID
+	}
+
+	writers := map[string]tableWriter{}
+	defer func() {
+		for _, w := range writers {
+			w.close()
+		}
+	}()
+
+	row := make([]interface{}, len(cols))
+	return src.each(srid, db, func(fid int64, vals []interface{}, geom orb.Geometry) {
+		key := ""
+		if partIdx >= 0 {
+			key = defaultPartition
+			if v := vals[partIdx]; v != nil && len(fmt.Sprint(v)) > 0 {
+				key = fmt.Sprint(v)
+			}
+		}
+
+		w, ok := writers[key]
+		if !ok {
+			w = newTableWriter(partitionPath(c.File, c.Partition, key, format), format, cols)
+			writers[key] = w
+		}
+
+		for i, col := range cols {
+			switch {
+			case col.idx >= 0:
+				row[i] = vals[col.idx]
+			case geom == nil:
+				row[i] = nil
+			case c.Geometry == "wkt":
+				row[i] = wkt.MarshalString(geom)
+			default:
+				data, err := wkb.Marshal(geom)
+				if err != nil {
+					log.Fatalln(err)
+				}
+				row[i] = data
+			}
+		}
+		w.write(row)
+	})
+}
+
+// tableType returns the SQLite type of the column kind, or BOOLEAN for the
+// BOOL columns of the tag tables.
+func tableType(kind string) string {
+	if strings.HasPrefix(strings.ToUpper(kind), "BOOL") {
+		return "BOOLEAN"
+	}
+	return sqliteType(kind)
+}
+
+// partitionPath returns the file of a partition, File itself without
+// partition.
+func partitionPath(file string, partition string, key string, format string) string {
+	if len(partition) == 0 {
+		return file
+	}
+
+	key = strings.NewReplacer("/", "_", `\`, "_", "=", "_").Replace(key)
+	dir := filepath.Join(file, fmt.Sprintf("%s=%s", partition, key))
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return filepath.Join(dir, partitionFileName+"."+format)
+}
+
+func newTableWriter(path string, format string, cols []tableColumn) tableWriter {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	switch format {
+	case "csv":
+		return newCSVWriter(f, cols)
+	case "parquet":
+		return newParquetWriter(f, cols)
+	}
+	log.Fatalf("Unknown table format %s", format)
+	return nil
+}
+
+type csvWriter struct {
+	f   *os.File
+	w   *csv.Writer
+	rec []string
+}
+
+func newCSVWriter(f *os.File, cols []tableColumn) *csvWriter {
+	w := &csvWriter{f: f, w: csv.NewWriter(f), rec: make([]string, len(cols))}
+	for i, col := range cols {
+		w.rec[i] = col.name
+	}
+	err := w.w.Write(w.rec)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return w
+}
+
+func (w *csvWriter) write(vals []interface{}) {
+	for i, v := range vals {
+		switch v := v.(type) {
+		case nil:
+			w.rec[i] = ""
+		case []byte:
+			w.rec[i] = hex.EncodeToString(v)
+		default:
+			w.rec[i] = fmt.Sprint(v)
+		}
+	}
+	err := w.w.Write(w.rec)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func (w *csvWriter) close() {
+	w.w.Flush()
+	if err := w.w.Error(); err != nil {
+		log.Fatalln(err)
+	}
+	w.f.Close()
+}
+
+// parquetWriter writes the rows with a schema typed from the column types,
+// e.g. the Tag.Type of the tag tables, each column being optional.
+type parquetWriter struct {
+	f    *os.File
+	w    *parquet.Writer
+	cols []tableColumn
+	// order is the index of each column in the schema, whose fields are sorted
+	// by name.
+	order []int
+	rows  []parquet.Row
+	// invalid counts the values of each column not of its type.
+	invalid []int
+}
+
+func newParquetWriter(f *os.File, cols []tableColumn) *parquetWriter {
+	group := parquet.Group{}
+	for _, col := range cols {
+		var node parquet.Node
+		switch col.kind {
+		case "INTEGER":
+			node = parquet.Int(64)
+		case "REAL":
+			node = parquet.Leaf(parquet.DoubleType)
+		case "BOOLEAN":
+			node = parquet.Leaf(parquet.BooleanType)
+		case "BLOB":
+			node = parquet.Leaf(parquet.ByteArrayType)
+		default:
+			node = parquet.String()
+		}
+		group[col.name] = parquet.Optional(node)
+	}
+	schema := parquet.NewSchema("feature", group)
+
+	w := &parquetWriter{f: f, w: parquet.NewWriter(f, schema), cols: cols, invalid: make([]int, len(cols))}
+	fields := schema.Fields()
+	for _, col := range cols {
+		w.order = append(w.order, slices.IndexFunc(fields, func(fd parquet.Field) bool { return fd.Name() == col.name }))
+	}
+	return w
+}
+
+func (w *parquetWriter) write(vals []interface{}) {
+	row := make(parquet.Row, len(vals))
+	for i, v := range vals {
+		v, ok := parquetValue(v, w.cols[i].kind)
+		if !ok {
+			w.invalid[i]++
+		}
+		if v == nil {
+			row[w.order[i]] = parquet.NullValue().Level(0, 0, w.order[i])
+		} else {
+			row[w.order[i]] = parquet.ValueOf(v).Level(0, 1, w.order[i])
+		}
+	}
+
+	w.rows = append(w.rows, row)
+	if len(w.rows) == 1024 {
+		w.flush()
+	}
+}
+
+func (w *parquetWriter) flush() {
+	_, err := w.w.WriteRows(w.rows)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	w.rows = w.rows[:0]
+}
+
+func (w *parquetWriter) close() {
+	w.flush()
+	err := w.w.Close()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	w.f.Close()
+
+	for i, n := range w.invalid {
+		if n > 0 {
+			log.Printf("%d values of %s in %s are not %s, written as NULL", n, w.cols[i].name, w.f.Name(), w.cols[i].kind)
+		}
+	}
+}
+
+// parquetValue converts the value to the type of the column, as SQLite does
+// not enforce the column types. A value which does not convert, such as a text
+// or a fractional number in an INTEGER column, is nil and false.
+func parquetValue(v interface{}, kind string) (interface{}, bool) {
+	if v == nil {
+		return nil, true
+	}
+
+	switch kind {
+	case "INTEGER":
+		switch v := v.(type) {
+		case int64:
+			return v, true
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+				return int64(v), true
+			}
+		case string:
+			if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return i, true
+			}
+		}
+		return nil, false
+	case "REAL":
+		switch v := v.(type) {
+		case int64:
+			return float64(v), true
+		case float64:
+			return v, true
+		case string:
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return f, true
+			}
+		}
+		return nil, false
+	case "BOOLEAN":
+		switch v := v.(type) {
+		case int64:
+			if v == 0 || v == 1 {
+				return v == 1, true
+			}
+		case string:
+			switch strings.ToLower(v) {
+			case "1", "yes", "true":
+				return true, true
+			case "0", "no", "false":
+				return false, true
+			}
+		}
+		return nil, false
+	case "BLOB":
+		if b, ok := v.([]byte); ok {
+			return b, true
+		}
+		return []byte(fmt.Sprint(v)), true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
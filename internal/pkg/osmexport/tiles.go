@@ -0,0 +1,343 @@
+package osmexport
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/simplify"
+	"gopkg.in/yaml.v3"
+)
+
+// TilesConfig generates the vector tiles of the layers from MinZoom to MaxZoom
+// into the MBTiles File. Buffer is the margin around each tile, in tile units
+// of the 4096 extent, in which the features are kept so they continue across
+// the tile edges.
+type TilesConfig struct {
+	File    string
+	Name    string
+	MinZoom int
+	MaxZoom int
+	Bbox    []float64
+	Buffer  float64
+	Layers  []TileLayer
+}
+
+// TileLayer writes Layer, joined by osm_id to the Joins tables, as the tile
+// layer Name, the layer by default, with the selected Fields between its
+// MinZoom and MaxZoom. The geometries are simplified by Simplify, in tile
+// units of the 4096 extent, so they get coarser at the lower zooms.
+type TileLayer struct {
+	Layer    string
+	Name     string
+	Joins    []string
+	Fields   []string
+	MinZoom  int
+	MaxZoom  int
+	Simplify float64
+}
+
+type tileFeatures map[maptile.Tile]map[string]*geojson.FeatureCollection
+
+func loadTilesConfig(filename string) TilesConfig {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	conf := TilesConfig{MaxZoom: 14, Buffer: 64}
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for i := range conf.Layers {
+		l := &conf.Layers[i]
+		if len(l.Name) == 0 {
+			l.Name = l.Layer
+		}
+		if l.MinZoom < conf.MinZoom {
+			l.MinZoom = conf.MinZoom
+		}
+		if l.MaxZoom == 0 || l.MaxZoom > conf.MaxZoom {
+			l.MaxZoom = conf.MaxZoom
+		}
+	}
+
+	return conf
+}
+
+// GenerateTiles writes the Mapbox Vector Tiles of the layers into an MBTiles
+// file. Each zoom is generated one tile column at a time, the features of the
+// column being read through the spatial index, so only the tiles of a column
+// are kept in memory.
+func GenerateTiles(strConfigFileName string, db *sql.DB) {
+	conf := loadTilesConfig(strConfigFileName)
+	log.Printf("Start generate tiles %s, zoom %d to %d", conf.File, conf.MinZoom, conf.MaxZoom)
+
+	os.Remove(conf.File)
+	mbt, err := sql.Open("sqlite3", conf.File)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer mbt.Close()
+	mbt.SetMaxOpenConns(1)
+
+	execAll(mbt,
+		"CREATE TABLE metadata (name TEXT, value TEXT)",
+		"CREATE TABLE tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB)",
+		"CREATE UNIQUE INDEX tile_index ON tiles (zoom_level, tile_column, tile_row)",
+	)
+
+	srcs := make([]*source, len(conf.Layers))
+	for i, l := range conf.Layers {
+		srcs[i] = newSource(ExportConfig{Layer: l.Layer, Joins: l.Joins, Fields: l.Fields, Bbox: conf.Bbox}, db)
+		if srcs[i].hasGeom && !hasSpatialIndex(l.Layer, db) {
+			log.Printf("%s has no spatial index, each tile column reads the whole layer", l.Layer)
+		}
+	}
+
+	extent, empty := tilesExtent(conf, srcs, db)
+	buf := conf.Buffer / mvt.DefaultExtent
+	total := 0
+	for z := conf.MinZoom; z <= conf.MaxZoom && !empty; z++ {
+		zoom := maptile.Zoom(z)
+		minTile := maptile.At(orb.Point{extent.Min[0], extent.Max[1]}, zoom)
+		maxTile := maptile.At(orb.Point{extent.Max[0], extent.Min[1]}, zoom)
+
+		count := 0
+		for x := minTile.X; x <= maxTile.X; x++ {
+			strip := maptile.New(x, minTile.Y, zoom).Bound(buf).Union(maptile.New(x, maxTile.Y, zoom).Bound(buf))
+			if len(conf.Bbox) == 4 {
+				strip = intersectBound(strip, orb.Bound{Min: orb.Point{conf.Bbox[0], conf.Bbox[1]}, Max: orb.Point{conf.Bbox[2], conf.Bbox[3]}})
+			}
+
+			tiles := tileFeatures{}
+			for i, l := range conf.Layers {
+				if z < l.MinZoom || z > l.MaxZoom {
+					continue
+				}
+				src := *srcs[i]
+				src.c.Bbox = []float64{strip.Min[0], strip.Min[1], strip.Max[0], strip.Max[1]}
+				src.each(exportSRID, db, func(fid int64, vals []interface{}, geom orb.Geometry) {
+					if geom == nil {
+						return
+					}
+
+					props := geojson.Properties{}
+					for j, col := range src.cols {
+						if vals[j] != nil {
+							props[col.out] = vals[j]
+						}
+					}
+					tiles.add(l.Name, fid, props, geom, x, zoom, buf)
+				})
+			}
+
+			count += writeTiles(tiles, conf.Layers, conf.Buffer, mbt)
+		}
+
+		total += count
+		log.Printf("Zoom %d, %d tiles", z, count)
+	}
+
+	writeTilesMetadata(conf, srcs, extent, mbt)
+
+	log.Printf("Finished generate tiles %s, %d tiles", conf.File, total)
+}
+
+// tilesExtent returns the extent of the layers in WGS 84 within Bbox, true
+// when there is no feature.
+func tilesExtent(conf TilesConfig, srcs []*source, db *sql.DB) (orb.Bound, bool) {
+	var (
+		extent orb.Bound
+		empty  = true
+	)
+	for _, src := range srcs {
+		if !src.hasGeom {
+			continue
+		}
+
+		strGeom := "GEOMETRY"
+		if src.srid != 0 && src.srid != exportSRID {
+			strGeom = fmt.Sprintf("ST_Transform(GEOMETRY, %d)", exportSRID)
+		}
+		var minX, minY, maxX, maxY sql.NullFloat64
+		strSql := fmt.Sprintf("SELECT MIN(MbrMinX(g)), MIN(MbrMinY(g)), MAX(MbrMaxX(g)), MAX(MbrMaxY(g)) FROM (SELECT %s AS g FROM %s)", strGeom, src.c.Layer)
+		err := db.QueryRow(strSql).Scan(&minX, &minY, &maxX, &maxY)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if !minX.Valid {
+			continue
+		}
+
+		b := orb.Bound{Min: orb.Point{minX.Float64, minY.Float64}, Max: orb.Point{maxX.Float64, maxY.Float64}}
+		if empty {
+			extent, empty = b, false
+		} else {
+			extent = extent.Union(b)
+		}
+	}
+
+	if len(conf.Bbox) == 4 && !empty {
+		bbox := orb.Bound{Min: orb.Point{conf.Bbox[0], conf.Bbox[1]}, Max: orb.Point{conf.Bbox[2], conf.Bbox[3]}}
+		if !extent.Intersects(bbox) {
+			return orb.Bound{}, true
+		}
+		extent = intersectBound(extent, bbox)
+	}
+	return extent, empty
+}
+
+func intersectBound(a orb.Bound, b orb.Bound) orb.Bound {
+	return orb.Bound{
+		Min: orb.Point{math.Max(a.Min[0], b.Min[0]), math.Max(a.Min[1], b.Min[1])},
+		Max: orb.Point{math.Min(a.Max[0], b.Max[0]), math.Min(a.Max[1], b.Max[1])},
+	}
+}
+
+// add puts a copy of the feature in every tile of column x at zoom z whose
+// bound, buffered by buf of a tile, the feature bound covers.
+func (tiles tileFeatures) add(name string, fid int64, props geojson.Properties, geom orb.Geometry, x uint32, z maptile.Zoom, buf float64) {
+	b := geom.Bound()
+	minFrac := maptile.Fraction(orb.Point{b.Min[0], b.Max[1]}, z)
+	maxFrac := maptile.Fraction(orb.Point{b.Max[0], b.Min[1]}, z)
+	if float64(x) < math.Floor(minFrac[0]-buf) || float64(x) > math.Floor(maxFrac[0]+buf) {
+		return
+	}
+
+	maxY := float64(uint32(1)<<uint32(z)) - 1
+	minTileY := uint32(math.Max(math.Floor(minFrac[1]-buf), 0))
+	maxTileY := uint32(math.Min(math.Floor(maxFrac[1]+buf), maxY))
+	for y := minTileY; y <= maxTileY; y++ {
+		t := maptile.New(x, y, z)
+		layers, ok := tiles[t]
+		if !ok {
+			layers = map[string]*geojson.FeatureCollection{}
+			tiles[t] = layers
+		}
+		fc, ok := layers[name]
+		if !ok {
+			fc = geojson.NewFeatureCollection()
+			layers[name] = fc
+		}
+
+		// The geometry is projected in place for each tile.
+		f := geojson.NewFeature(orb.Clone(geom))
+		f.ID = fid
+		f.Properties = props
+		fc.Append(f)
+	}
+}
+
+// writeTiles clips the features of each tile to the tile extent buffered by
+// buffer tile units and writes the tiles.
+func writeTiles(tiles tileFeatures, layers []TileLayer, buffer float64, mbt *sql.DB) int {
+	tolerances := map[string]float64{}
+	for _, l := range layers {
+		tolerances[l.Name] = l.Simplify
+	}
+	clip := orb.Bound{
+		Min: orb.Point{-buffer, -buffer},
+		Max: orb.Point{mvt.DefaultExtent + buffer, mvt.DefaultExtent + buffer},
+	}
+
+	tx, err := mbt.Begin()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	stmt, err := tx.Prepare("INSERT INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer stmt.Close()
+
+	count := 0
+	for t, fcs := range tiles {
+		ls := mvt.NewLayers(fcs)
+		ls.ProjectToTile(t)
+		ls.Clip(clip)
+		for _, l := range ls {
+			if tol := tolerances[l.Name]; tol > 0 {
+				l.Simplify(simplify.DouglasPeucker(tol))
+			}
+		}
+		ls.RemoveEmpty(1.0, 1.0)
+
+		data, err := mvt.MarshalGzipped(ls)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		// MBTiles rows follow the TMS scheme, counted from the south.
+		row := (1 << uint(t.Z)) - 1 - int(t.Y)
+		_, err = stmt.Exec(int(t.Z), int(t.X), row, data)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		count++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return count
+}
+
+func writeTilesMetadata(conf TilesConfig, srcs []*source, extent orb.Bound, mbt *sql.DB) {
+	type vectorLayer struct {
+		ID      string            `json:"id"`
+		Fields  map[string]string `json:"fields"`
+		MinZoom int               `json:"minzoom"`
+		MaxZoom int               `json:"maxzoom"`
+	}
+	vectorLayers := []vectorLayer{}
+	for i, l := range conf.Layers {
+		vl := vectorLayer{ID: l.Name, Fields: map[string]string{}, MinZoom: l.MinZoom, MaxZoom: l.MaxZoom}
+		for _, col := range srcs[i].cols {
+			switch sqliteType(col.kind) {
+			case "INTEGER", "REAL":
+				vl.Fields[col.out] = "Number"
+			default:
+				vl.Fields[col.out] = "String"
+			}
+		}
+		vectorLayers = append(vectorLayers, vl)
+	}
+	strJSON, err := json.Marshal(map[string]interface{}{"vector_layers": vectorLayers})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	name := conf.Name
+	if len(name) == 0 {
+		name = conf.File
+	}
+	center := extent.Center()
+	metadata := [][2]string{
+		{"name", name},
+		{"format", "pbf"},
+		{"type", "overlay"},
+		{"minzoom", fmt.Sprint(conf.MinZoom)},
+		{"maxzoom", fmt.Sprint(conf.MaxZoom)},
+		{"bounds", fmt.Sprintf("%f,%f,%f,%f", extent.Min[0], extent.Min[1], extent.Max[0], extent.Max[1])},
+		{"center", fmt.Sprintf("%f,%f,%d", center[0], center[1], conf.MinZoom)},
+		{"json", string(strJSON)},
+	}
+	for _, m := range metadata {
+		_, err := mbt.Exec("INSERT INTO metadata (name, value) VALUES (?, ?)", m[0], m[1])
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package osmgeom
+
+import (
+	"database/sql"
+	"log"
+)
+
+// GeometryTypes of the geometry_type units of the spatialite geometry_columns.
+var GeometryTypes = map[int]string{
+	1: "POINT",
+	2: "LINESTRING",
+	3: "POLYGON",
+	4: "MULTIPOINT",
+	5: "MULTILINESTRING",
+	6: "MULTIPOLYGON",
+	7: "GEOMETRYCOLLECTION",
+}
+
+// CoordDimensions of the geometry_type thousands of geometry_columns.
+var CoordDimensions = map[int]string{
+	0: "XY",
+	1: "XYZ",
+	2: "XYM",
+	3: "XYZM",
+}
+
+// LayerSRID returns the SRID of the GEOMETRY column of the layer registered in
+// geometry_columns, 0 when the layer is not registered.
+func LayerSRID(tblName string, db *sql.DB) int {
+	var srid int
+	row := db.QueryRow("SELECT srid FROM geometry_columns WHERE lower(f_table_name) = lower(?) AND lower(f_geometry_column) = 'geometry'", tblName)
+	err := row.Scan(&srid)
+	if err == sql.ErrNoRows {
+		return 0
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return srid
+}
+
+// LayerGeometryType returns the geometry_type of the GEOMETRY column of the
+// layer registered in geometry_columns, 0 when the layer is not registered.
+func LayerGeometryType(tblName string, db *sql.DB) int {
+	var geomType int
+	row := db.QueryRow("SELECT geometry_type FROM geometry_columns WHERE lower(f_table_name) = lower(?) AND lower(f_geometry_column) = 'geometry'", tblName)
+	err := row.Scan(&geomType)
+	if err == sql.ErrNoRows {
+		return 0
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return geomType
+}
@@ -0,0 +1,293 @@
+package osmimport
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/planar"
+	"github.com/paulmach/osm"
+)
+
+const errorLayer = "multipolygon_errors"
+
+// addMultipolygon assembles the rings of a multipolygon or boundary relation
+// from its member ways, the inner rings going to the outer ring containing
+// them. A relation which cannot be assembled, or whose rings would make an
+// invalid geometry, is written to the errors table.
+func (im *importer) addMultipolygon(r *osm.Relation, tags osm.Tags) {
+	var outers, inners []orb.LineString
+	for _, m := range r.Members {
+		if m.Type != osm.TypeWay {
+			continue
+		}
+		l, ok := im.wayLine(osm.WayID(m.Ref))
+		if !ok {
+			im.insertError(r, fmt.Sprintf("missing way %d", m.Ref))
+			return
+		}
+		if m.Role == "inner" {
+			inners = append(inners, l)
+		} else {
+			outers = append(outers, l)
+		}
+	}
+	if len(outers) == 0 {
+		im.insertError(r, "no outer way")
+		return
+	}
+
+	outerRings, err := assembleRings(outers)
+	if err != nil {
+		im.insertError(r, fmt.Sprintf("outer %v", err))
+		return
+	}
+	innerRings, err := assembleRings(inners)
+	if err != nil {
+		im.insertError(r, fmt.Sprintf("inner %v", err))
+		return
+	}
+	if err := checkRings(outerRings, innerRings); err != nil {
+		im.insertError(r, err.Error())
+		return
+	}
+
+	mp := make(orb.MultiPolygon, len(outerRings))
+	for i, ring := range outerRings {
+		if ring.Orientation() != orb.CCW {
+			ring.Reverse()
+		}
+		mp[i] = orb.Polygon{ring}
+	}
+	for _, ring := range innerRings {
+		i := containingRing(outerRings, ring)
+		if i < 0 {
+			im.insertError(r, fmt.Sprintf("inner ring at %v outside the outer rings", ring[0]))
+			return
+		}
+		if ring.Orientation() != orb.CW {
+			ring.Reverse()
+		}
+		mp[i] = append(mp[i], ring)
+	}
+
+	im.insert("multipolygons", []interface{}{fmt.Sprint(r.ID), nil}, relationMetadata(r), tags, mp)
+}
+
+// assembleRings joins the lines at their shared endpoints into closed rings.
+func assembleRings(lines []orb.LineString) ([]orb.Ring, error) {
+	pool := make([]orb.LineString, len(lines))
+	copy(pool, lines)
+
+	rings := []orb.Ring{}
+	for len(pool) > 0 {
+		ring := append(orb.LineString{}, pool[0]...)
+		pool = pool[1:]
+
+		for ring[0] != ring[len(ring)-1] {
+			end := ring[len(ring)-1]
+			found := false
+			for i, l := range pool {
+				switch end {
+				case l[0]:
+					ring = append(ring, l[1:]...)
+				case l[len(l)-1]:
+					for j := len(l) - 2; j >= 0; j-- {
+						ring = append(ring, l[j])
+					}
+				default:
+					continue
+				}
+				pool = append(pool[:i], pool[i+1:]...)
+				found = true
+				break
+			}
+			if !found {
+				return nil, fmt.Errorf("ring not closed at %v", end)
+			}
+		}
+
+		if len(ring) < 4 {
+			return nil, fmt.Errorf("ring at %v with less than 3 points", ring[0])
+		}
+		rings = append(rings, orb.Ring(ring))
+	}
+
+	return rings, nil
+}
+
+// checkRings returns why the rings do not make a valid multipolygon: a ring
+// crossing or touching itself, outer rings crossing or touching each other, or
+// an outer ring inside another one. The inner rings are checked for being in
+// an outer ring when they are assigned to it.
+func checkRings(outers []orb.Ring, inners []orb.Ring) error {
+	for _, ring := range outers {
+		if p, ok := crossingEdges([]orb.Ring{ring}, true); ok {
+			return fmt.Errorf("outer ring self-intersecting at %v", p)
+		}
+	}
+	for _, ring := range inners {
+		if p, ok := crossingEdges([]orb.Ring{ring}, true); ok {
+			return fmt.Errorf("inner ring self-intersecting at %v", p)
+		}
+	}
+
+	if p, ok := crossingEdges(outers, false); ok {
+		return fmt.Errorf("outer rings touching at %v", p)
+	}
+	// The outer rings do not touch, so one point tells whether a ring is in
+	// another one.
+	for i, ring := range outers {
+		for j, other := range outers {
+			if i != j && planar.RingContains(other, ring[0]) {
+				return fmt.Errorf("outer ring at %v inside another outer ring", ring[0])
+			}
+		}
+	}
+
+	return nil
+}
+
+type ringEdge struct {
+	a    orb.Point
+	b    orb.Point
+	ring int
+	i    int
+}
+
+// crossingEdges returns a point where two edges cross or touch, the edges being
+// of the same ring when self is set and of different rings otherwise. The
+// consecutive edges of a ring only count when they overlap. The edges are swept
+// by x so that large rings are not compared edge by edge.
+func crossingEdges(rings []orb.Ring, self bool) (orb.Point, bool) {
+	edges := []ringEdge{}
+	counts := make([]int, len(rings))
+	for r, ring := range rings {
+		// Repeated vertices make no edge.
+		var prev orb.Point
+		n := 0
+		for i, p := range ring {
+			if i > 0 && p == prev {
+				continue
+			}
+			if i > 0 {
+				edges = append(edges, ringEdge{a: prev, b: p, ring: r, i: n})
+				n++
+			}
+			prev = p
+		}
+		counts[r] = n
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		return math.Min(edges[i].a[0], edges[i].b[0]) < math.Min(edges[j].a[0], edges[j].b[0])
+	})
+
+	for i, e := range edges {
+		maxX := math.Max(e.a[0], e.b[0])
+		for _, f := range edges[i+1:] {
+			if math.Min(f.a[0], f.b[0]) > maxX {
+				break
+			}
+			if (e.ring == f.ring) != self {
+				continue
+			}
+			if self {
+				n := counts[e.ring]
+				if f.i == (e.i+1)%n || e.i == (f.i+1)%n {
+					// Consecutive edges share a vertex, and only overlap
+					// when the ring turns back on itself.
+					if p, ok := overlapping(e, f); ok {
+						return p, true
+					}
+					continue
+				}
+			}
+			if p, ok := segmentsIntersect(e.a, e.b, f.a, f.b); ok {
+				return p, true
+			}
+		}
+	}
+
+	return orb.Point{}, false
+}
+
+// overlapping tells whether two consecutive edges overlap, returning their
+// shared vertex.
+func overlapping(e ringEdge, f ringEdge) (orb.Point, bool) {
+	v, p, q := e.b, e.a, f.b
+	if f.b == e.a {
+		v, p, q = e.a, e.b, f.a
+	}
+	if cross(v, p, q) != 0 {
+		return orb.Point{}, false
+	}
+	return v, (p[0]-v[0])*(q[0]-v[0])+(p[1]-v[1])*(q[1]-v[1]) > 0
+}
+
+// cross returns the cross product of a-o and b-o, positive when a, b turn
+// counterclockwise around o.
+func cross(o orb.Point, a orb.Point, b orb.Point) float64 {
+	return (a[0]-o[0])*(b[1]-o[1]) - (a[1]-o[1])*(b[0]-o[0])
+}
+
+// onSegment tells whether p, collinear with a-b, lies on it.
+func onSegment(a orb.Point, b orb.Point, p orb.Point) bool {
+	return math.Min(a[0], b[0]) <= p[0] && p[0] <= math.Max(a[0], b[0]) &&
+		math.Min(a[1], b[1]) <= p[1] && p[1] <= math.Max(a[1], b[1])
+}
+
+// segmentsIntersect returns a point shared by the segments a-b and c-d, the
+// crossing point or else an end lying on the other segment.
+func segmentsIntersect(a orb.Point, b orb.Point, c orb.Point, d orb.Point) (orb.Point, bool) {
+	d1, d2 := cross(a, b, c), cross(a, b, d)
+	d3, d4 := cross(c, d, a), cross(c, d, b)
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		t := d3 / (d3 - d4)
+		return orb.Point{a[0] + t*(b[0]-a[0]), a[1] + t*(b[1]-a[1])}, true
+	}
+
+	switch {
+	case d1 == 0 && onSegment(a, b, c):
+		return c, true
+	case d2 == 0 && onSegment(a, b, d):
+		return d, true
+	case d3 == 0 && onSegment(c, d, a):
+		return a, true
+	case d4 == 0 && onSegment(c, d, b):
+		return b, true
+	}
+	return orb.Point{}, false
+}
+
+// containingRing returns the index of the smallest ring containing all the
+// points of inner, -1 when none contains it.
+func containingRing(rings []orb.Ring, inner orb.Ring) int {
+	found := -1
+	area := 0.0
+	for i, ring := range rings {
+		contained := true
+		for _, p := range inner {
+			if !planar.RingContains(ring, p) {
+				contained = false
+				break
+			}
+		}
+		if !contained {
+			continue
+		}
+		if a := planar.Area(ring); found < 0 || a < area {
+			found, area = i, a
+		}
+	}
+	return found
+}
+
+func (im *importer) insertError(r *osm.Relation, strErr string) {
+	_, err := im.errStmt.Exec(fmt.Sprint(r.ID), r.Tags.Find("type"), strErr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	im.errors++
+}
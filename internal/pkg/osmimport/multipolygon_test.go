@@ -0,0 +1,79 @@
+package osmimport
+
+import (
+	"testing"
+
+	"github.com/paulmach/orb"
+)
+
+func TestCheckRings(t *testing.T) {
+	square := orb.Ring{{0, 0}, {4, 0}, {4, 4}, {0, 4}, {0, 0}}
+	tests := []struct {
+		name   string
+		outers []orb.Ring
+		inners []orb.Ring
+		want   string
+	}{
+		{
+			name:   "square with a hole",
+			outers: []orb.Ring{square},
+			inners: []orb.Ring{{{1, 1}, {1, 2}, {2, 2}, {2, 1}, {1, 1}}},
+		},
+		{
+			name:   "repeated vertex",
+			outers: []orb.Ring{{{0, 0}, {4, 0}, {4, 0}, {4, 4}, {0, 4}, {0, 0}}},
+		},
+		{
+			name:   "bow tie",
+			outers: []orb.Ring{{{0, 0}, {2, 2}, {2, 0}, {0, 2}, {0, 0}}},
+			want:   "outer ring self-intersecting at [1 1]",
+		},
+		{
+			name:   "ring touching itself on a vertex",
+			outers: []orb.Ring{{{0, 0}, {2, 0}, {1, 1}, {2, 2}, {0, 2}, {1, 1}, {0, 0}}},
+			want:   "outer ring self-intersecting at [1 1]",
+		},
+		{
+			name:   "ring turning back",
+			outers: []orb.Ring{{{0, 0}, {4, 0}, {4, 4}, {4, 2}, {0, 4}, {0, 0}}},
+			want:   "outer ring self-intersecting at [4 2]",
+		},
+		{
+			name:   "self-intersecting inner ring",
+			outers: []orb.Ring{square},
+			inners: []orb.Ring{{{1, 1}, {3, 3}, {3, 1}, {1, 3}, {1, 1}}},
+			want:   "inner ring self-intersecting at [2 2]",
+		},
+		{
+			name:   "outers sharing an edge",
+			outers: []orb.Ring{square, {{4, 0}, {8, 0}, {8, 4}, {4, 4}, {4, 0}}},
+			want:   "outer rings touching at [4 0]",
+		},
+		{
+			name:   "outers crossing",
+			outers: []orb.Ring{square, {{2, 2}, {6, 2}, {6, 6}, {2, 6}, {2, 2}}},
+			want:   "outer rings touching at [2 4]",
+		},
+		{
+			name:   "outer inside another",
+			outers: []orb.Ring{square, {{1, 1}, {2, 1}, {2, 2}, {1, 2}, {1, 1}}},
+			want:   "outer ring at [1 1] inside another outer ring",
+		},
+		{
+			name:   "disjoint outers",
+			outers: []orb.Ring{square, {{5, 0}, {8, 0}, {8, 4}, {5, 4}, {5, 0}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if err := checkRings(tt.outers, tt.inners); err != nil {
+				got = err.Error()
+			}
+			if got != tt.want {
+				t.Errorf("checkRings() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
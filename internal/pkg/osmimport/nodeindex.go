@@ -0,0 +1,170 @@
+package osmimport
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"log"
+	"os"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/osm"
+)
+
+// nodeIndex keeps the coordinates of the nodes and the node ids of the ways in
+// a temporary SQLite file, so the ways and relations can be built from files
+// whose nodes do not fit in memory.
+type nodeIndex struct {
+	filename string
+	db       *sql.DB
+	tx       *sql.Tx
+	count    int
+
+	nodeIns *sql.Stmt
+	nodeSel *sql.Stmt
+	wayIns  *sql.Stmt
+	waySel  *sql.Stmt
+}
+
+func newNodeIndex(dir string) *nodeIndex {
+	f, err := os.CreateTemp(dir, "osmimport-*.sqlite")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	f.Close()
+
+	db, err := sql.Open("sqlite3", "file:"+f.Name()+"?_journal_mode=OFF&_synchronous=OFF")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// The lookups must see the rows of the open transaction.
+	db.SetMaxOpenConns(1)
+
+	strSqls := []string{
+		"CREATE TABLE nodes (id INTEGER PRIMARY KEY, lon REAL, lat REAL)",
+		"CREATE TABLE ways (id INTEGER PRIMARY KEY, nodes BLOB)",
+	}
+	for _, strSql := range strSqls {
+		_, err := db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	idx := &nodeIndex{filename: f.Name(), db: db}
+	idx.begin()
+
+	return idx
+}
+
+func (idx *nodeIndex) begin() {
+	tx, err := idx.db.Begin()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	idx.tx = tx
+
+	for _, s := range []struct {
+		stmt   **sql.Stmt
+		strSql string
+	}{
+		{&idx.nodeIns, "INSERT OR REPLACE INTO nodes (id, lon, lat) VALUES (?, ?, ?)"},
+		{&idx.nodeSel, "SELECT lon, lat FROM nodes WHERE id = ?"},
+		{&idx.wayIns, "INSERT OR REPLACE INTO ways (id, nodes) VALUES (?, ?)"},
+		{&idx.waySel, "SELECT nodes FROM ways WHERE id = ?"},
+	} {
+		*s.stmt, err = tx.Prepare(s.strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func (idx *nodeIndex) commit() {
+	for _, stmt := range []*sql.Stmt{idx.nodeIns, idx.nodeSel, idx.wayIns, idx.waySel} {
+		stmt.Close()
+	}
+	err := idx.tx.Commit()
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func (idx *nodeIndex) written() {
+	idx.count++
+	if idx.count%importBatchSize == 0 {
+		idx.commit()
+		idx.begin()
+	}
+}
+
+// close removes the index file.
+func (idx *nodeIndex) close() {
+	idx.commit()
+	idx.db.Close()
+
+	err := os.Remove(idx.filename)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func (idx *nodeIndex) addNode(id osm.NodeID, p orb.Point) {
+	_, err := idx.nodeIns.Exec(int64(id), p.Lon(), p.Lat())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	idx.written()
+}
+
+func (idx *nodeIndex) node(id osm.NodeID) (orb.Point, bool) {
+	var p orb.Point
+	err := idx.nodeSel.QueryRow(int64(id)).Scan(&p[0], &p[1])
+	if err == sql.ErrNoRows {
+		return p, false
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return p, true
+}
+
+// addWay keeps the node ids of the way as varint deltas.
+func (idx *nodeIndex) addWay(id osm.WayID, ids []osm.NodeID) {
+	buf := make([]byte, 0, len(ids)*3)
+	prev := int64(0)
+	for _, nid := range ids {
+		buf = binary.AppendVarint(buf, int64(nid)-prev)
+		prev = int64(nid)
+	}
+
+	_, err := idx.wayIns.Exec(int64(id), buf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	idx.written()
+}
+
+func (idx *nodeIndex) way(id osm.WayID) ([]osm.NodeID, bool) {
+	var buf []byte
+	err := idx.waySel.QueryRow(int64(id)).Scan(&buf)
+	if err == sql.ErrNoRows {
+		return nil, false
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ids := []osm.NodeID{}
+	prev := int64(0)
+	for len(buf) > 0 {
+		d, n := binary.Varint(buf)
+		if n <= 0 {
+			log.Fatalf("Nodes of way %d are corrupt in the node index", id)
+		}
+		prev += d
+		ids = append(ids, osm.NodeID(prev))
+		buf = buf[n:]
+	}
+	return ids, true
+}
@@ -0,0 +1,625 @@
+package osmimport
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkb"
+	"github.com/paulmach/osm"
+	"github.com/paulmach/osm/osmpbf"
+	"github.com/paulmach/osm/osmxml"
+	"gopkg.in/yaml.v3"
+)
+
+const importBatchSize = 100000
+
+// ImportConfig sets the OSM file to import and the tags written to their own
+// column in each layer, the other tags being kept in other_tags. The columns
+// default to the ones of the ogr2ogr OSM driver. With Metadata the version,
+// timestamp, uid, user and changeset of the features are kept in the osm_*
+// columns. AreaTags are the keys making a closed way an area. WriteBack keeps
+// what writing the edits back to OSM needs: the metadata, the ignored tags and
+// the nodes of the ways in way_nodes. The nodes are indexed in a temporary file
+// in IndexDir, the system temporary directory by default.
+type ImportConfig struct {
+	File             string
+	IndexDir         string
+	Metadata         bool
+	WriteBack        bool
+	Points           []string
+	Lines            []string
+	MultiLineStrings []string
+	MultiPolygons    []string
+	OtherRelations   []string
+	AreaTags         []string
+}
+
+var (
+	defaultPoints           = []string{"name", "barrier", "highway", "ref", "address", "is_in", "place", "man_made"}
+	defaultLines            = []string{"name", "highway", "waterway", "aerialway", "barrier", "man_made", "railway"}
+	defaultMultiLineStrings = []string{"name", "type"}
+	defaultMultiPolygons    = []string{"name", "type", "aeroway", "amenity", "admin_level", "barrier", "boundary", "building", "craft", "geological", "historic", "land_area", "landuse", "leisure", "man_made", "military", "natural", "office", "place", "shop", "sport", "tourism"}
+	defaultOtherRelations   = []string{"name", "type"}
+
+	// ignoredTags are dropped from the features, as ogr2ogr does.
+	ignoredTags = map[string]bool{
+		"created_by": true, "converted_by": true, "source": true, "time": true, "ele": true,
+		"note": true, "todo": true, "fixme": true, "FIXME": true,
+	}
+
+	// defaultAreaTags make a closed way an area, unless tagged area=no or
+	// with one of the lineValues.
+	defaultAreaTags = []string{"aeroway", "amenity", "boundary", "building", "craft", "geological", "historic", "landuse", "leisure", "military", "natural", "office", "place", "shop", "sport", "tourism"}
+
+	lineValues = map[string]map[string]bool{
+		"natural":  {"coastline": true, "cliff": true, "ridge": true, "arete": true, "tree_row": true, "earth_bank": true},
+		"leisure":  {"track": true, "slipway": true},
+		"man_made": {"embankment": true, "breakwater": true, "groyne": true},
+		"barrier":  {"city_wall": true, "retaining_wall": true},
+	}
+
+	metadataCols = []string{"osm_version", "osm_timestamp", "osm_uid", "osm_user", "osm_changeset"}
+
+	// zOrders of the highway classes, as osm2pgsql and ogr2ogr compute z_order.
+	zOrders = map[string]int{
+		"minor": 3, "road": 3, "unclassified": 3, "residential": 3,
+		"tertiary_link": 4, "tertiary": 4,
+		"secondary_link": 6, "secondary": 6,
+		"primary_link": 7, "primary": 7,
+		"trunk_link": 8, "trunk": 8,
+		"motorway_link": 9, "motorway": 9,
+	}
+)
+
+type layer struct {
+	name     string
+	geomType string
+	cols     []string
+	extra    []string
+	stmt     *sql.Stmt
+}
+
+// metadata of an OSM element, written when the import keeps it.
+type metadata struct {
+	version   int
+	timestamp time.Time
+	uid       osm.UserID
+	user      string
+	changeset osm.ChangesetID
+}
+
+type importer struct {
+	db       *sql.DB
+	tx       *sql.Tx
+	count    int
+	layers   map[string]*layer
+	metadata bool
+	areaTags []string
+	errStmt  *sql.Stmt
+	errors   int
+
+	writeBack   bool
+	wayNodeStmt *sql.Stmt
+
+	relStmt    *sql.Stmt
+	memberStmt *sql.Stmt
+
+	index   *nodeIndex
+	missing int
+}
+
+func loadImportConfig(filename string) ImportConfig {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var conf ImportConfig
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if conf.Points == nil {
+		conf.Points = defaultPoints
+	}
+	if conf.Lines == nil {
+		conf.Lines = defaultLines
+	}
+	if conf.MultiLineStrings == nil {
+		conf.MultiLineStrings = defaultMultiLineStrings
+	}
+	if conf.MultiPolygons == nil {
+		conf.MultiPolygons = defaultMultiPolygons
+	}
+	if conf.OtherRelations == nil {
+		conf.OtherRelations = defaultOtherRelations
+	}
+	if conf.AreaTags == nil {
+		conf.AreaTags = defaultAreaTags
+	}
+
+	return conf
+}
+
+// Import reads an OSM PBF or XML file into the points, lines,
+// multilinestrings, multipolygons and other_relations layers, as ogr2ogr
+// converts it.
+func Import(strConfigFileName string, db *sql.DB) {
+	conf := loadImportConfig(strConfigFileName)
+	log.Printf("Start import %s", conf.File)
+
+	f, err := os.Open(conf.File)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+
+	scanner := newScanner(conf.File, f)
+	defer scanner.Close()
+
+	initSpatialMetadata(db)
+
+	im := &importer{
+		db:        db,
+		metadata:  conf.Metadata || conf.WriteBack,
+		areaTags:  conf.AreaTags,
+		writeBack: conf.WriteBack,
+		layers: map[string]*layer{
+			"points":           {name: "points", geomType: "POINT", cols: conf.Points},
+			"lines":            {name: "lines", geomType: "LINESTRING", cols: conf.Lines, extra: []string{"z_order"}},
+			"multilinestrings": {name: "multilinestrings", geomType: "MULTILINESTRING", cols: conf.MultiLineStrings},
+			"multipolygons":    {name: "multipolygons", geomType: "MULTIPOLYGON", cols: conf.MultiPolygons, extra: []string{"osm_way_id"}},
+			"other_relations":  {name: "other_relations", geomType: "GEOMETRYCOLLECTION", cols: conf.OtherRelations},
+		},
+		index: newNodeIndex(conf.IndexDir),
+	}
+	defer im.index.close()
+	for _, l := range im.layers {
+		if im.metadata {
+			l.extra = append(l.extra, metadataCols...)
+		}
+		createLayer(l, db)
+	}
+	createErrorTable(db)
+	createRelationTables(db)
+	if im.writeBack {
+		createWayNodeTable(db)
+	}
+
+	im.begin()
+	for scanner.Scan() {
+		switch o := scanner.Object().(type) {
+		case *osm.Node:
+			im.addNode(o)
+		case *osm.Way:
+			im.addWay(o)
+		case *osm.Relation:
+			im.addRelation(o)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalln(err)
+	}
+	im.commit()
+
+	for _, l := range im.layers {
+		strSql := fmt.Sprintf("SELECT CreateSpatialIndex('%s', 'GEOMETRY')", l.name)
+		_, err := db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	createMemberIndex(db)
+
+	if im.missing > 0 {
+		log.Printf("%d ways miss nodes in the file and are skipped", im.missing)
+	}
+	if im.errors > 0 {
+		log.Printf("%d multipolygon relations are invalid, see %s", im.errors, errorLayer)
+	}
+	log.Printf("Finished import %s, %d features", conf.File, im.count)
+}
+
+// newScanner reads the file as PBF, or as XML by its .osm, .osm.bz2 or .osm.gz
+// extension.
+func newScanner(filename string, f *os.File) osm.Scanner {
+	var r io.Reader = f
+	switch {
+	case strings.HasSuffix(filename, ".pbf"):
+		return osmpbf.New(context.Background(), f, runtime.NumCPU())
+	case strings.HasSuffix(filename, ".bz2"):
+		r = bzip2.NewReader(f)
+	case strings.HasSuffix(filename, ".gz"):
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return gzipScanner{osmxml.New(context.Background(), gr), gr}
+	}
+	return osmxml.New(context.Background(), r)
+}
+
+// gzipScanner closes the gzip reader with the scanner.
+type gzipScanner struct {
+	osm.Scanner
+	gr *gzip.Reader
+}
+
+func (s gzipScanner) Close() error {
+	err := s.Scanner.Close()
+	if e := s.gr.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func initSpatialMetadata(db *sql.DB) {
+	var ok int
+	err := db.QueryRow("SELECT CheckSpatialMetaData()").Scan(&ok)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if ok > 0 {
+		return
+	}
+
+	_, err = db.Exec("SELECT InitSpatialMetadata(1)")
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func createLayer(l *layer, db *sql.DB) {
+	strSql := fmt.Sprintf("SELECT DropGeoTable('%s')", l.name)
+	_, err := db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	strCols := "ogc_fid INTEGER PRIMARY KEY AUTOINCREMENT, osm_id VARCHAR"
+	for _, col := range l.extra {
+		switch col {
+		case "z_order", "osm_version", "osm_uid", "osm_changeset":
+			strCols += fmt.Sprintf(", %s INTEGER", col)
+		default:
+			strCols += fmt.Sprintf(`, "%s" VARCHAR`, col)
+		}
+	}
+	for _, col := range l.cols {
+		strCols += fmt.Sprintf(`, "%s" VARCHAR`, col)
+	}
+	strCols += ", other_tags VARCHAR"
+
+	strSql = fmt.Sprintf("CREATE TABLE %s (%s)", l.name, strCols)
+	_, err = db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	strSql = fmt.Sprintf("SELECT AddGeometryColumn('%s', 'GEOMETRY', 4326, '%s', 'XY')", l.name, l.geomType)
+	_, err = db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func createErrorTable(db *sql.DB) {
+	strSql := fmt.Sprintf("DROP TABLE IF EXISTS %s", errorLayer)
+	_, err := db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	strSql = fmt.Sprintf("CREATE TABLE %s (ogc_fid INTEGER PRIMARY KEY AUTOINCREMENT, osm_id VARCHAR, type VARCHAR, error VARCHAR)", errorLayer)
+	_, err = db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func (im *importer) begin() {
+	tx, err := im.db.Begin()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	im.tx = tx
+
+	for _, l := range im.layers {
+		cols := append(append([]string{"osm_id"}, l.extra...), l.cols...)
+		strCols := fmt.Sprintf(`"%s"`, strings.Join(cols, `", "`))
+		strVals := strings.Repeat("?, ", len(cols))
+		strSql := fmt.Sprintf("INSERT INTO %s (%s, other_tags, GEOMETRY) VALUES (%s?, GeomFromWKB(?, 4326))", l.name, strCols, strVals)
+		l.stmt, err = tx.Prepare(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	strSql := fmt.Sprintf("INSERT INTO %s (osm_id, type, error) VALUES (?, ?, ?)", errorLayer)
+	im.errStmt, err = tx.Prepare(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	im.prepareRelations()
+	if im.writeBack {
+		im.prepareWayNodes()
+	}
+}
+
+func (im *importer) commit() {
+	for _, l := range im.layers {
+		l.stmt.Close()
+	}
+	im.errStmt.Close()
+	im.relStmt.Close()
+	im.memberStmt.Close()
+	if im.wayNodeStmt != nil {
+		im.wayNodeStmt.Close()
+	}
+	err := im.tx.Commit()
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// insert writes a feature, ids being the values of osm_id and of the extra
+// columns, the tags of the layer columns going to them and the others to
+// other_tags.
+func (im *importer) insert(layerName string, ids []interface{}, m metadata, tags osm.Tags, geom orb.Geometry) {
+	l := im.layers[layerName]
+
+	var geomData []byte
+	if geom != nil {
+		data, err := wkb.Marshal(geom)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		geomData = data
+	}
+
+	args := append([]interface{}{}, ids...)
+	if im.metadata {
+		var ts interface{}
+		if !m.timestamp.IsZero() {
+			ts = m.timestamp.UTC().Format(time.RFC3339)
+		}
+		args = append(args, m.version, ts, int64(m.uid), m.user, int64(m.changeset))
+	}
+	isCol := make(map[string]bool, len(l.cols))
+	for _, col := range l.cols {
+		isCol[col] = true
+		if v := tags.Find(col); len(v) > 0 {
+			args = append(args, v)
+		} else {
+			args = append(args, nil)
+		}
+	}
+	if strTags := formatTags(tags, isCol); len(strTags) > 0 {
+		args = append(args, strTags)
+	} else {
+		args = append(args, nil)
+	}
+	args = append(args, geomData)
+
+	_, err := l.stmt.Exec(args...)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	im.count++
+	if im.count%importBatchSize == 0 {
+		im.commit()
+		im.begin()
+	}
+}
+
+func (im *importer) addNode(n *osm.Node) {
+	im.index.addNode(n.ID, n.Point())
+
+	tags := im.featureTags(n.Tags)
+	if len(tags) == 0 {
+		return
+	}
+	im.insert("points", []interface{}{fmt.Sprint(n.ID)}, metadata{n.Version, n.Timestamp, n.UserID, n.User, n.ChangesetID}, tags, n.Point())
+}
+
+func (im *importer) addWay(w *osm.Way) {
+	ids := make([]osm.NodeID, len(w.Nodes))
+	for i, wn := range w.Nodes {
+		ids[i] = wn.ID
+	}
+	im.index.addWay(w.ID, ids)
+
+	tags := im.featureTags(w.Tags)
+	if len(tags) == 0 {
+		return
+	}
+	l, ok := im.wayLine(w.ID)
+	if !ok {
+		im.missing++
+		return
+	}
+
+	if im.writeBack {
+		im.insertWayNodes(w.ID, ids)
+	}
+
+	if isArea(l, tags, im.areaTags) {
+		im.insert("multipolygons", []interface{}{nil, fmt.Sprint(w.ID)}, wayMetadata(w), tags, orb.MultiPolygon{{orb.Ring(l)}})
+		return
+	}
+	im.insert("lines", []interface{}{fmt.Sprint(w.ID), zOrder(tags)}, wayMetadata(w), tags, l)
+}
+
+func (im *importer) addRelation(r *osm.Relation) {
+	im.insertRelation(r)
+
+	tags := im.featureTags(r.Tags)
+	if len(tags) == 0 {
+		return
+	}
+
+	switch tags.Find("type") {
+	case "multipolygon", "boundary":
+		im.addMultipolygon(r, tags)
+	case "multilinestring", "route":
+		mls := orb.MultiLineString{}
+		for _, m := range r.Members {
+			if m.Type != osm.TypeWay {
+				continue
+			}
+			if l, ok := im.wayLine(osm.WayID(m.Ref)); ok {
+				mls = append(mls, l)
+			}
+		}
+		var geom orb.Geometry
+		if len(mls) > 0 {
+			geom = mls
+		}
+		im.insert("multilinestrings", []interface{}{fmt.Sprint(r.ID)}, relationMetadata(r), tags, geom)
+	default:
+		// The members are kept in order, e.g. from, via and to of a restriction.
+		col := orb.Collection{}
+		for _, m := range r.Members {
+			switch m.Type {
+			case osm.TypeNode:
+				if p, ok := im.index.node(osm.NodeID(m.Ref)); ok {
+					col = append(col, p)
+				}
+			case osm.TypeWay:
+				if l, ok := im.wayLine(osm.WayID(m.Ref)); ok {
+					col = append(col, l)
+				}
+			}
+		}
+		var geom orb.Geometry
+		if len(col) > 0 {
+			geom = col
+		}
+		im.insert("other_relations", []interface{}{fmt.Sprint(r.ID)}, relationMetadata(r), tags, geom)
+	}
+}
+
+// wayLine returns the line of a way read before, false when any node is
+// missing from the file.
+func (im *importer) wayLine(id osm.WayID) (orb.LineString, bool) {
+	ids, ok := im.index.way(id)
+	if !ok || len(ids) < 2 {
+		return nil, false
+	}
+
+	l := make(orb.LineString, 0, len(ids))
+	for _, nid := range ids {
+		p, ok := im.index.node(nid)
+		if !ok {
+			return nil, false
+		}
+		l = append(l, p)
+	}
+	return l, true
+}
+
+func wayMetadata(w *osm.Way) metadata {
+	return metadata{w.Version, w.Timestamp, w.UserID, w.User, w.ChangesetID}
+}
+
+func relationMetadata(r *osm.Relation) metadata {
+	return metadata{r.Version, r.Timestamp, r.UserID, r.User, r.ChangesetID}
+}
+
+// featureTags returns the tags written with a feature, none when only ignored
+// tags are left. With writeBack the ignored tags are kept too, so the edits
+// written back to OSM do not drop them.
+func (im *importer) featureTags(tags osm.Tags) osm.Tags {
+	kept := keptTags(tags)
+	if im.writeBack && len(kept) > 0 {
+		return tags
+	}
+	return kept
+}
+
+func keptTags(tags osm.Tags) osm.Tags {
+	kept := make(osm.Tags, 0, len(tags))
+	for _, t := range tags {
+		if ignoredTags[t.Key] || strings.HasPrefix(t.Key, "openGeoDB:") {
+			continue
+		}
+		kept = append(kept, t)
+	}
+	return kept
+}
+
+// isArea tells whether a closed way is an area, by area=yes or one of the
+// areaTags which is not one of the lineValues, e.g. natural=coastline.
+func isArea(l orb.LineString, tags osm.Tags, areaTags []string) bool {
+	if len(l) < 4 || l[0] != l[len(l)-1] {
+		return false
+	}
+
+	switch tags.Find("area") {
+	case "yes":
+		return true
+	case "no":
+		return false
+	}
+	for _, k := range areaTags {
+		if v := tags.Find(k); len(v) > 0 && !lineValues[k][v] {
+			return true
+		}
+	}
+	return false
+}
+
+func zOrder(tags osm.Tags) int {
+	z := zOrders[tags.Find("highway")]
+	if tags.HasTag("railway") {
+		z += 5
+	}
+
+	var layer int
+	fmt.Sscan(tags.Find("layer"), &layer)
+	z += layer * 10
+
+	if v := tags.Find("bridge"); len(v) > 0 && v != "no" {
+		z += 10
+	}
+	if v := tags.Find("tunnel"); len(v) > 0 && v != "no" {
+		z -= 10
+	}
+	return z
+}
+
+// formatTags returns the tags not in cols as the hstore text of other_tags,
+// e.g. "oneway"=>"yes","lanes"=>"2".
+func formatTags(tags osm.Tags, cols map[string]bool) string {
+	var sb strings.Builder
+	for _, t := range tags {
+		if cols[t.Key] {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(quoteTag(t.Key))
+		sb.WriteString("=>")
+		sb.WriteString(quoteTag(t.Value))
+	}
+	return sb.String()
+}
+
+func quoteTag(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
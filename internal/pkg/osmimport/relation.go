@@ -0,0 +1,71 @@
+package osmimport
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/paulmach/osm"
+)
+
+const (
+	relationLayer = "relations"
+	memberLayer   = "relation_members"
+)
+
+// createRelationTables creates the tables keeping every relation with its tags
+// and its members in order, which the layers flatten.
+func createRelationTables(db *sql.DB) {
+	strSqls := []string{
+		fmt.Sprintf("DROP TABLE IF EXISTS %s", relationLayer),
+		fmt.Sprintf("DROP TABLE IF EXISTS %s", memberLayer),
+		fmt.Sprintf("CREATE TABLE %s (relation_id BIGINT PRIMARY KEY, type VARCHAR, name VARCHAR, tags VARCHAR)", relationLayer),
+		fmt.Sprintf("CREATE TABLE %s (relation_id BIGINT, seq INTEGER, member_type VARCHAR, member_id BIGINT, role VARCHAR, PRIMARY KEY (relation_id, seq))", memberLayer),
+	}
+	for _, strSql := range strSqls {
+		_, err := db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func createMemberIndex(db *sql.DB) {
+	strSql := fmt.Sprintf("CREATE INDEX idx_%s_member ON %s (member_type, member_id)", memberLayer, memberLayer)
+	_, err := db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func (im *importer) prepareRelations() {
+	var err error
+	strSql := fmt.Sprintf("INSERT INTO %s (relation_id, type, name, tags) VALUES (?, ?, ?, ?)", relationLayer)
+	im.relStmt, err = im.tx.Prepare(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	strSql = fmt.Sprintf("INSERT INTO %s (relation_id, seq, member_type, member_id, role) VALUES (?, ?, ?, ?, ?)", memberLayer)
+	im.memberStmt, err = im.tx.Prepare(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func (im *importer) insertRelation(r *osm.Relation) {
+	var strTags interface{}
+	if len(r.Tags) > 0 {
+		strTags = formatTags(r.Tags, nil)
+	}
+	_, err := im.relStmt.Exec(int64(r.ID), r.Tags.Find("type"), r.Tags.Find("name"), strTags)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for i, m := range r.Members {
+		_, err := im.memberStmt.Exec(int64(r.ID), i+1, string(m.Type), m.Ref, m.Role)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
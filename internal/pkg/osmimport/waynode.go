@@ -0,0 +1,44 @@
+package osmimport
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/paulmach/osm"
+)
+
+const wayNodeLayer = "way_nodes"
+
+// createWayNodeTable creates the table keeping the nodes of the imported ways
+// in order, which the lines only keep as vertices.
+func createWayNodeTable(db *sql.DB) {
+	strSqls := []string{
+		fmt.Sprintf("DROP TABLE IF EXISTS %s", wayNodeLayer),
+		fmt.Sprintf("CREATE TABLE %s (way_id BIGINT, seq INTEGER, node_id BIGINT, PRIMARY KEY (way_id, seq))", wayNodeLayer),
+	}
+	for _, strSql := range strSqls {
+		_, err := db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func (im *importer) prepareWayNodes() {
+	var err error
+	strSql := fmt.Sprintf("INSERT INTO %s (way_id, seq, node_id) VALUES (?, ?, ?)", wayNodeLayer)
+	im.wayNodeStmt, err = im.tx.Prepare(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func (im *importer) insertWayNodes(id osm.WayID, ids []osm.NodeID) {
+	for i, nid := range ids {
+		_, err := im.wayNodeStmt.Exec(int64(id), i+1, int64(nid))
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
@@ -0,0 +1,520 @@
+package osmnode
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	OAT "navinfo.com/osmsqlitetools/internal/pkg/osmattr"
+	OGM "navinfo.com/osmsqlitetools/internal/pkg/osmgeom"
+)
+
+type ComponentConfigs struct {
+	Configs []ComponentConfig
+}
+
+type ComponentConfig struct {
+	LineLayer      string
+	LineNodeLayer  string
+	ComponentLayer string
+	IslandLayer    string
+	IslandSize     int
+	Oneway         bool
+}
+
+type lineEnds struct {
+	from   int64
+	to     int64
+	oneway int
+}
+
+func loadComponentConfigs(filename string) ComponentConfigs {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var conf ComponentConfigs
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return conf
+}
+
+func AnalyzeComponents(strConfigFileName string, db *sql.DB) {
+	conf := loadComponentConfigs(strConfigFileName)
+	for _, c := range conf.Configs {
+		log.Println("Start analyze connected components")
+
+		lines := loadLineEnds(c.LineLayer, c.LineNodeLayer, c.Oneway, db)
+
+		wcc := weakComponents(lines)
+		addIntColumn(c.LineLayer, "wcc_id", db)
+		updateLineComponents(c.LineLayer, "wcc_id", wcc, db)
+
+		var scc map[int64]int
+		if c.Oneway {
+			scc = strongComponents(lines)
+			addIntColumn(c.LineLayer, "scc_id", db)
+			updateLineComponents(c.LineLayer, "scc_id", scc, db)
+		}
+
+		if len(c.ComponentLayer) > 0 {
+			createComponentTable(c.ComponentLayer, lines, wcc, scc, db)
+		}
+		if len(c.IslandLayer) > 0 {
+			createIslandTable(c, wcc, db)
+		}
+
+		log.Println("Finished analyze connected components")
+	}
+}
+
+func loadLineEnds(lineLayer string, lineNodeLayer string, oneway bool, db *sql.DB) map[int64]*lineEnds {
+	lines := make(map[int64]*lineEnds)
+
+	strSql := fmt.Sprintf("SELECT lines_fid, node_fid, pos_type FROM %s WHERE pos_type IN (1, 2) AND node_fid IS NOT NULL", lineNodeLayer)
+	rows, err := db.Query(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			lineFid int64
+			nodeFid int64
+			posType int
+		)
+		if err := rows.Scan(&lineFid, &nodeFid, &posType); err != nil {
+			log.Fatalln(err)
+		}
+
+		l, ok := lines[lineFid]
+		if !ok {
+			l = &lineEnds{from: -1, to: -1}
+			lines[lineFid] = l
+		}
+		if posType == 1 {
+			l.from = nodeFid
+		} else {
+			l.to = nodeFid
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	for fid, l := range lines {
+		if l.from == -1 || l.to == -1 {
+			delete(lines, fid)
+		}
+	}
+
+	if oneway {
+		for fid, dir := range loadOneways(lineLayer, db) {
+			if l, ok := lines[fid]; ok {
+				l.oneway = dir
+			}
+		}
+	}
+
+	return lines
+}
+
+func loadOneways(lineLayer string, db *sql.DB) map[int64]int {
+	dirs := make(map[int64]int)
+	if !OAT.IsColExist(lineLayer, "other_tags", db) {
+		return dirs
+	}
+
+	strHighway := "NULL"
+	if OAT.IsColExist(lineLayer, "highway", db) {
+		strHighway = "highway"
+	}
+
+	strSql := fmt.Sprintf("SELECT ogc_fid, %s, other_tags FROM %s", strHighway, lineLayer)
+	rows, err := db.Query(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			fid     int64
+			highway sql.NullString
+			tags    sql.NullString
+		)
+		if err := rows.Scan(&fid, &highway, &tags); err != nil {
+			log.Fatalln(err)
+		}
+
+		if dir := onewayOf(highway.String, OAT.ParseTags(tags.String)); dir != 0 {
+			dirs[fid] = dir
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	return dirs
+}
+
+// onewayOf returns 1 when the line can only be travelled from its first to its
+// last point, -1 for the opposite direction and 0 when both are allowed.
+func onewayOf(highway string, tags map[string]string) int {
+	switch tags["oneway"] {
+	case "yes", "true", "1":
+		return 1
+	case "-1", "reverse":
+		return -1
+	case "no", "false", "0":
+		return 0
+	}
+
+	if highway == "motorway" || tags["junction"] == "roundabout" {
+		return 1
+	}
+
+	return 0
+}
+
+func findRoot(parent map[int64]int64, n int64) int64 {
+	for parent[n] != n {
+		parent[n] = parent[parent[n]]
+		n = parent[n]
+	}
+	return n
+}
+
+// weakComponents labels each line with a component id, 1 being the largest.
+func weakComponents(lines map[int64]*lineEnds) map[int64]int {
+	parent := make(map[int64]int64)
+	for _, l := range lines {
+		for _, n := range []int64{l.from, l.to} {
+			if _, ok := parent[n]; !ok {
+				parent[n] = n
+			}
+		}
+	}
+	for _, l := range lines {
+		a, b := findRoot(parent, l.from), findRoot(parent, l.to)
+		if a != b {
+			parent[a] = b
+		}
+	}
+
+	roots := make(map[int64]int64, len(lines))
+	for fid, l := range lines {
+		roots[fid] = findRoot(parent, l.from)
+	}
+
+	return numberComponents(roots)
+}
+
+// strongComponents labels each line whose both ends lie in the same strongly
+// connected component of the directed graph. Lines bridging two components are
+// left out.
+func strongComponents(lines map[int64]*lineEnds) map[int64]int {
+	adj := make(map[int64][]int64)
+	for _, l := range lines {
+		if l.oneway >= 0 {
+			adj[l.from] = append(adj[l.from], l.to)
+		}
+		if l.oneway <= 0 {
+			adj[l.to] = append(adj[l.to], l.from)
+		}
+		if _, ok := adj[l.from]; !ok {
+			adj[l.from] = nil
+		}
+		if _, ok := adj[l.to]; !ok {
+			adj[l.to] = nil
+		}
+	}
+
+	nodes := make([]int64, 0, len(adj))
+	for n := range adj {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+
+	// Iterative Tarjan to avoid deep recursion on long chains.
+	var (
+		index   = make(map[int64]int)
+		lowLink = make(map[int64]int)
+		onStack = make(map[int64]bool)
+		stack   []int64
+		sccRoot = make(map[int64]int64)
+		next    int
+	)
+	type frame struct {
+		node int64
+		edge int
+	}
+	for _, start := range nodes {
+		if _, ok := index[start]; ok {
+			continue
+		}
+
+		callStack := []frame{{node: start}}
+		index[start], lowLink[start] = next, next
+		next++
+		stack = append(stack, start)
+		onStack[start] = true
+
+		for len(callStack) > 0 {
+			f := &callStack[len(callStack)-1]
+			if f.edge < len(adj[f.node]) {
+				w := adj[f.node][f.edge]
+				f.edge++
+				if _, ok := index[w]; !ok {
+					index[w], lowLink[w] = next, next
+					next++
+					stack = append(stack, w)
+					onStack[w] = true
+					callStack = append(callStack, frame{node: w})
+				} else if onStack[w] && index[w] < lowLink[f.node] {
+					lowLink[f.node] = index[w]
+				}
+				continue
+			}
+
+			v := f.node
+			if lowLink[v] == index[v] {
+				for {
+					w := stack[len(stack)-1]
+					stack = stack[:len(stack)-1]
+					onStack[w] = false
+					sccRoot[w] = v
+					if w == v {
+						break
+					}
+				}
+			}
+			callStack = callStack[:len(callStack)-1]
+			if len(callStack) > 0 {
+				p := callStack[len(callStack)-1].node
+				if lowLink[v] < lowLink[p] {
+					lowLink[p] = lowLink[v]
+				}
+			}
+		}
+	}
+
+	roots := make(map[int64]int64)
+	for fid, l := range lines {
+		if sccRoot[l.from] == sccRoot[l.to] {
+			roots[fid] = sccRoot[l.from]
+		}
+	}
+
+	return numberComponents(roots)
+}
+
+// numberComponents renumbers the components by descending size, ties broken by
+// the smallest line id so the numbering is stable between runs.
+func numberComponents(roots map[int64]int64) map[int64]int {
+	type comp struct {
+		root    int64
+		size    int
+		minLine int64
+	}
+	comps := make(map[int64]*comp)
+	for fid, r := range roots {
+		cp, ok := comps[r]
+		if !ok {
+			cp = &comp{root: r, minLine: fid}
+			comps[r] = cp
+		}
+		cp.size++
+		if fid < cp.minLine {
+			cp.minLine = fid
+		}
+	}
+
+	sorted := make([]*comp, 0, len(comps))
+	for _, cp := range comps {
+		sorted = append(sorted, cp)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].size != sorted[j].size {
+			return sorted[i].size > sorted[j].size
+		}
+		return sorted[i].minLine < sorted[j].minLine
+	})
+
+	ids := make(map[int64]int, len(sorted))
+	for i, cp := range sorted {
+		ids[cp.root] = i + 1
+	}
+
+	labels := make(map[int64]int, len(roots))
+	for fid, r := range roots {
+		labels[fid] = ids[r]
+	}
+
+	return labels
+}
+
+func addIntColumn(tblName string, colName string, db *sql.DB) {
+	if OAT.IsColExist(tblName, colName, db) {
+		strSql := fmt.Sprintf("UPDATE %s SET %s = NULL", tblName, colName)
+		_, err := db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	strSql := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s INTEGER", tblName, colName)
+	_, err := db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func updateLineComponents(lineLayer string, colName string, labels map[int64]int, db *sql.DB) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	strSql := fmt.Sprintf("UPDATE %s SET %s = ? WHERE ogc_fid = ?", lineLayer, colName)
+	stmt, err := tx.Prepare(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer stmt.Close()
+
+	for fid, id := range labels {
+		_, err := stmt.Exec(id, fid)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func createComponentTable(tblName string, lines map[int64]*lineEnds, wcc map[int64]int, scc map[int64]int, db *sql.DB) {
+	strSql := fmt.Sprintf("DROP TABLE IF EXISTS %s", tblName)
+	_, err := db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	strSql = fmt.Sprintf("CREATE TABLE %s (ogc_fid INTEGER PRIMARY KEY AUTOINCREMENT, kind VARCHAR, component_id INTEGER, lines INTEGER, nodes INTEGER)", tblName)
+	_, err = db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	strSql = fmt.Sprintf("INSERT INTO %s (kind, component_id, lines, nodes) VALUES (?, ?, ?, ?)", tblName)
+	stmt, err := tx.Prepare(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer stmt.Close()
+
+	for _, k := range []struct {
+		kind   string
+		labels map[int64]int
+	}{{"weak", wcc}, {"strong", scc}} {
+		if k.labels == nil {
+			continue
+		}
+
+		sizes := make(map[int]int)
+		nodes := make(map[int]map[int64]bool)
+		for fid, id := range k.labels {
+			sizes[id]++
+			if nodes[id] == nil {
+				nodes[id] = make(map[int64]bool)
+			}
+			nodes[id][lines[fid].from] = true
+			nodes[id][lines[fid].to] = true
+		}
+
+		for id := 1; id <= len(sizes); id++ {
+			_, err := stmt.Exec(k.kind, id, sizes[id], len(nodes[id]))
+			if err != nil {
+				log.Fatalln(err)
+			}
+		}
+
+		strTop := make([]string, 0, 5)
+		for id := 1; id <= len(sizes) && id <= 5; id++ {
+			strTop = append(strTop, fmt.Sprintf("%d", sizes[id]))
+		}
+		log.Printf("%d %s components, largest sizes: %s", len(sizes), k.kind, strings.Join(strTop, ", "))
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func createIslandTable(c ComponentConfig, wcc map[int64]int, db *sql.DB) {
+	sizes := make(map[int]int)
+	for _, id := range wcc {
+		sizes[id]++
+	}
+
+	ids := make([]int, 0)
+	for id, size := range sizes {
+		// The largest component is the main network and never an island.
+		if id == 1 || (c.IslandSize > 0 && size > c.IslandSize) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	strIds := make([]string, len(ids))
+	for i, id := range ids {
+		strIds[i] = fmt.Sprintf("%d", id)
+	}
+
+	strSql := fmt.Sprintf("SELECT DropGeoTable('%s')", c.IslandLayer)
+	_, err := db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	strSql = fmt.Sprintf("CREATE TABLE %s AS SELECT * FROM %s WHERE wcc_id IN (%s)", c.IslandLayer, c.LineLayer, strings.Join(strIds, ", "))
+	_, err = db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	srid := OGM.LayerSRID(c.LineLayer, db)
+	if srid == 0 {
+		srid = defaultSRID
+	}
+	// The islands keep the geometry type and dimensions of the line layer, a
+	// layer missing from geometry_columns being taken as LINESTRING XY.
+	geomType := OGM.LayerGeometryType(c.LineLayer, db)
+	if geomType == 0 {
+		geomType = 2
+	}
+	strSql = fmt.Sprintf("SELECT RecoverGeometryColumn('%s', 'GEOMETRY', %d, '%s', '%s')", c.IslandLayer, srid, OGM.GeometryTypes[geomType%1000], OGM.CoordDimensions[geomType/1000])
+	_, err = db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	log.Printf("%d islands written to %s", len(ids), c.IslandLayer)
+}
@@ -0,0 +1,400 @@
+package osmnode
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkb"
+)
+
+// resplitLines updates a split line layer after edits: the deleted lines are
+// removed, the inserted and updated lines are split together with the lines
+// they touch, and the line nodes and nodes of these lines are updated in place
+// instead of being rebuilt. The lines at the former nodes of the removed lines
+// are split again too, the pieces of a way cut at such a node being joined
+// first. The nodes shared with the peer networks keep the lines of these
+// networks. A transformed line layer takes the changed lines, by ogc_fid in
+// the imported layer, from it.
+func resplitLines(c LinesSplitConfig, peers []LinesSplitConfig, db *sql.DB) {
+	log.Printf("Start resplit line, %d inserted, %d updated, %d deleted", len(c.Inserted), len(c.Updated), len(c.Deleted))
+
+	fidTblName := fmt.Sprintf("tmp_%s_resplit", c.LineLayer)
+	nodeTblName := fmt.Sprintf("tmp_%s_resplit", c.NodeLayer)
+	viewName := fmt.Sprintf("resplit_%s", c.LineLayer)
+	createFidTable(fidTblName, db)
+	createFidTable(nodeTblName, db)
+
+	initLineage(c, db)
+	var changed, removed, deleted []int64
+	if len(c.sourceLayer) > 0 {
+		changed, removed = syncTransformLayer(c, db)
+		deleted = removed
+	} else {
+		changed = append(append([]int64{}, c.Inserted...), c.Updated...)
+		removed = append(append([]int64{}, c.Updated...), c.Deleted...)
+		deleted = c.Deleted
+
+		// An updated line starts a new lineage, as its vertices changed.
+		strSql := fmt.Sprintf("UPDATE %s SET orig_fid = ogc_fid, seg_index = 0, from_vertex = 0, to_vertex = ST_NumPoints(GEOMETRY) - 1 WHERE ogc_fid IN (%s)", c.LineLayer, fidList(changed))
+		_, err := db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	insertFids(fidTblName, changed, db)
+
+	touched, joined := joinTouchedLines(c, removed, changed, db)
+	insertFids(fidTblName, touched, db)
+	removed = append(removed, joined...)
+	deleted = append(append([]int64{}, deleted...), joined...)
+
+	strSqls := []string{
+		fmt.Sprintf("DELETE FROM %s WHERE ogc_fid IN (%s)", c.LineLayer, fidList(deleted)),
+		fmt.Sprintf(`INSERT OR IGNORE INTO %s (ogc_fid) SELECT l.ogc_fid FROM %s AS s JOIN %s AS l ON l.ogc_fid IN (
+			SELECT rowid FROM SpatialIndex WHERE f_table_name = '%s' AND f_geometry_column = 'GEOMETRY' AND search_frame = s.GEOMETRY)
+			WHERE s.ogc_fid IN (%s) AND ST_Intersects(s.GEOMETRY, l.GEOMETRY)`,
+			fidTblName, c.LineLayer, c.LineLayer, c.LineLayer, fidList(changed)),
+		fmt.Sprintf("INSERT OR IGNORE INTO %s (ogc_fid) SELECT node_fid FROM %s WHERE lines_fid IN (%s) OR lines_fid IN (SELECT ogc_fid FROM %s)", nodeTblName, c.LineNodeLayer, fidList(removed), fidTblName),
+		fmt.Sprintf("DELETE FROM %s WHERE lines_fid IN (%s) OR lines_fid IN (SELECT ogc_fid FROM %s)", c.LineNodeLayer, fidList(removed), fidTblName),
+		fmt.Sprintf("DROP VIEW IF EXISTS %s", viewName),
+		fmt.Sprintf("CREATE VIEW %s AS SELECT * FROM %s WHERE ogc_fid IN (SELECT ogc_fid FROM %s)", viewName, c.LineLayer, fidTblName),
+	}
+	for _, strSql := range strSqls {
+		_, err := db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	var maxFid int64
+	strSql := fmt.Sprintf("SELECT IFNULL(MAX(ogc_fid), 0) FROM %s", c.LineLayer)
+	err := db.QueryRow(strSql).Scan(&maxFid)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// The vertices are only taken from the lines to resplit, the others being
+	// split already, while the lines are cut in the line layer itself.
+	cv := c
+	cv.LineLayer = viewName
+	cv.LineNodeLayer = fmt.Sprintf("resplit_%s", c.LineNodeLayer)
+	createLineNode(cv, db, false)
+	addSplitPoints(cv, db)
+	addNetworkPoints(cv, peers, db)
+
+	tmpTblName := createTmpTable(cv, db)
+	cs := c
+	cs.LineNodeLayer = cv.LineNodeLayer
+	splitLines(cs, tmpTblName, db)
+	dropTmpTable(tmpTblName, db)
+
+	// The new pieces are added to the lines to resplit, the view then reading
+	// them too, and once more after being split by length.
+	strSql = fmt.Sprintf("INSERT OR IGNORE INTO %s (ogc_fid) SELECT ogc_fid FROM %s WHERE ogc_fid > ?", fidTblName, c.LineLayer)
+	_, err = db.Exec(strSql, maxFid)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if c.MaxLength > 0 {
+		splitByLength(c, viewName, db)
+		_, err = db.Exec(strSql, maxFid)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	updateLineNodes(c, peers, fidTblName, nodeTblName, db)
+	updateSegIndex(c, db)
+
+	strSqls = []string{
+		fmt.Sprintf("SELECT DropGeoTable('%s')", cv.LineNodeLayer),
+		fmt.Sprintf("DROP VIEW IF EXISTS %s", viewName),
+		fmt.Sprintf("DROP TABLE IF EXISTS %s", fidTblName),
+		fmt.Sprintf("DROP TABLE IF EXISTS %s", nodeTblName),
+	}
+	for _, strSql := range strSqls {
+		_, err := db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	linkSplitPoints(c, db)
+	classifyNodes(append([]LinesSplitConfig{c}, peers...), db)
+	linkRelationLines(c, db)
+
+	log.Println("Finished resplit line")
+}
+
+// syncTransformLayer copies the inserted and updated lines of the imported
+// layer, reprojected, into the transformed line layer as new lines keeping the
+// ogc_fid of the imported line in orig_fid, and returns their ogc_fids with the
+// ones of the pieces of the updated and deleted lines, which are to be removed.
+func syncTransformLayer(c LinesSplitConfig, db *sql.DB) ([]int64, []int64) {
+	removed := []int64{}
+	strSql := fmt.Sprintf("SELECT ogc_fid FROM %s WHERE orig_fid IN (%s)", c.LineLayer, fidList(append(append([]int64{}, c.Updated...), c.Deleted...)))
+	rows, err := db.Query(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for rows.Next() {
+		var fid int64
+		if err := rows.Scan(&fid); err != nil {
+			log.Fatalln(err)
+		}
+		removed = append(removed, fid)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+	rows.Close()
+
+	var maxFid int64
+	strSql = fmt.Sprintf("SELECT IFNULL(MAX(ogc_fid), 0) FROM %s", c.LineLayer)
+	err = db.QueryRow(strSql).Scan(&maxFid)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	strCols := getColsSql(c.sourceLayer, db, "orig_fid", "seg_index", "from_vertex", "to_vertex")
+	strSql = fmt.Sprintf(`INSERT INTO %s (%s, orig_fid, seg_index, from_vertex, to_vertex, GEOMETRY)
+		SELECT %s, ogc_fid, 0, 0, ST_NumPoints(GEOMETRY) - 1, ST_Force2D(ST_Transform(GEOMETRY, %d)) FROM %s WHERE ogc_fid IN (%s) ORDER BY ogc_fid`,
+		c.LineLayer, strCols, strCols, c.SRID, c.sourceLayer, fidList(append(append([]int64{}, c.Inserted...), c.Updated...)))
+	_, err = db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	changed := []int64{}
+	strSql = fmt.Sprintf("SELECT ogc_fid FROM %s WHERE ogc_fid > ?", c.LineLayer)
+	rows, err = db.Query(strSql, maxFid)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fid int64
+		if err := rows.Scan(&fid); err != nil {
+			log.Fatalln(err)
+		}
+		changed = append(changed, fid)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	log.Printf("Synced %d lines from %s, %d lines to remove", len(changed), c.sourceLayer, len(removed))
+	return changed, removed
+}
+
+type linePiece struct {
+	fid     int64
+	origFid int64
+	from    int
+	to      int
+	line    orb.LineString
+	start   int64
+	end     int64
+}
+
+// joinTouchedLines returns the lines, other than the changed and removed ones,
+// at the nodes of the removed lines. Consecutive pieces of a way meeting at
+// such a node are joined into the first one, the others being returned to be
+// removed too, so the resplit only cuts them again where a node remains.
+func joinTouchedLines(c LinesSplitConfig, removed []int64, changed []int64, db *sql.DB) ([]int64, []int64) {
+	strNodes := fmt.Sprintf("SELECT node_fid FROM %s WHERE lines_fid IN (%s)", c.LineNodeLayer, fidList(removed))
+	nodes := map[int64]bool{}
+	rows, err := db.Query(strNodes)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for rows.Next() {
+		var fid sql.NullInt64
+		if err := rows.Scan(&fid); err != nil {
+			log.Fatalln(err)
+		}
+		if fid.Valid {
+			nodes[fid.Int64] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+	rows.Close()
+
+	strSql := fmt.Sprintf(`SELECT l.ogc_fid, l.orig_fid, l.from_vertex, l.to_vertex, ST_AsBinary(l.GEOMETRY), s.node_fid, e.node_fid
+		FROM %s AS l JOIN %s AS s ON s.lines_fid = l.ogc_fid AND s.pos_type = 1 JOIN %s AS e ON e.lines_fid = l.ogc_fid AND e.pos_type = 2
+		WHERE l.ogc_fid IN (SELECT lines_fid FROM %s WHERE node_fid IN (%s)) AND l.ogc_fid NOT IN (%s)
+		ORDER BY l.orig_fid, l.from_vertex, l.ogc_fid`,
+		c.LineLayer, c.LineNodeLayer, c.LineNodeLayer, c.LineNodeLayer, strNodes, fidList(append(append([]int64{}, removed...), changed...)))
+	rows, err = db.Query(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	pieces := []*linePiece{}
+	for rows.Next() {
+		var (
+			p        linePiece
+			geomData []byte
+			start    sql.NullInt64
+			end      sql.NullInt64
+		)
+		if err := rows.Scan(&p.fid, &p.origFid, &p.from, &p.to, &geomData, &start, &end); err != nil {
+			log.Fatalln(err)
+		}
+		geom, err := wkb.Unmarshal(geomData)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		p.line, _ = geom.(orb.LineString)
+		p.start, p.end = start.Int64, end.Int64
+		pieces = append(pieces, &p)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+	rows.Close()
+
+	touched := []int64{}
+	joined := []int64{}
+	updates := []*linePiece{}
+	var cur *linePiece
+	for _, p := range pieces {
+		if cur != nil && len(cur.line) > 0 && len(p.line) > 0 && p.origFid == cur.origFid && p.from == cur.to && p.start == cur.end && nodes[p.start] {
+			cur.line = append(cur.line, p.line[1:]...)
+			cur.to, cur.end = p.to, p.end
+			joined = append(joined, p.fid)
+			if len(updates) == 0 || updates[len(updates)-1] != cur {
+				updates = append(updates, cur)
+			}
+			continue
+		}
+		cur = p
+		touched = append(touched, p.fid)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	strSql = fmt.Sprintf("UPDATE %s SET GEOMETRY = GeomFromWKB(?, %d), to_vertex = ? WHERE ogc_fid = ?", c.LineLayer, c.SRID)
+	stmt, err := tx.Prepare(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer stmt.Close()
+	for _, p := range updates {
+		data, err := wkb.Marshal(p.line)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		_, err = stmt.Exec(data, p.to, p.fid)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return touched, joined
+}
+
+// updateLineNodes writes the endpoints of the lines in fidTblName to the line
+// node layer, adds the nodes missing at them, and recounts the intersections
+// and networks of the nodes in nodeTblName and of the nodes of these lines over
+// the line nodes of c and its peers, the nodes left without line in any of the
+// networks being deleted.
+func updateLineNodes(c LinesSplitConfig, peers []LinesSplitConfig, fidTblName string, nodeTblName string, db *sql.DB) {
+	strCounts := make([]string, 0, len(peers)+1)
+	strNetworks := make([]string, 0, len(peers)+1)
+	for i, m := range append([]LinesSplitConfig{c}, peers...) {
+		strRef := fmt.Sprintf("SELECT 1 FROM %s AS ln WHERE ln.node_fid = %s.ogc_fid", m.LineNodeLayer, c.NodeLayer)
+		strCounts = append(strCounts, fmt.Sprintf("(SELECT COUNT(*) FROM %s AS ln WHERE ln.node_fid = %s.ogc_fid)", m.LineNodeLayer, c.NodeLayer))
+		strNetworks = append(strNetworks, fmt.Sprintf("SELECT %d AS i, '%s' AS network WHERE EXISTS (%s)", i, m.network(), strRef))
+	}
+
+	strSqls := []string{
+		fmt.Sprintf(`INSERT INTO %s (lines_fid, osm_id, order_id, pos_type)
+			SELECT ogc_fid, osm_id, 1, 1 FROM %s WHERE ogc_fid IN (SELECT ogc_fid FROM %s)
+			UNION ALL
+			SELECT ogc_fid, osm_id, ST_NumPoints(GEOMETRY), 2 FROM %s WHERE ogc_fid IN (SELECT ogc_fid FROM %s)`,
+			c.LineNodeLayer, c.LineLayer, fidTblName, c.LineLayer, fidTblName),
+		fmt.Sprintf(`INSERT INTO %s (intersections, networks, GEOMETRY) SELECT 0, '%s', geom FROM (
+			SELECT ST_StartPoint(GEOMETRY) AS geom FROM %s WHERE ogc_fid IN (SELECT ogc_fid FROM %s)
+			UNION
+			SELECT ST_EndPoint(GEOMETRY) AS geom FROM %s WHERE ogc_fid IN (SELECT ogc_fid FROM %s))
+			WHERE geom IS NOT NULL AND geom NOT IN (SELECT GEOMETRY FROM %s)`,
+			c.NodeLayer, c.network(), c.LineLayer, fidTblName, c.LineLayer, fidTblName, c.NodeLayer),
+		fmt.Sprintf(`UPDATE %s SET node_fid = (SELECT n.ogc_fid FROM %s AS n WHERE n.GEOMETRY = (
+			SELECT CASE WHEN %s.pos_type = 1 THEN ST_StartPoint(l.GEOMETRY) ELSE ST_EndPoint(l.GEOMETRY) END FROM %s AS l WHERE l.ogc_fid = %s.lines_fid))
+			WHERE lines_fid IN (SELECT ogc_fid FROM %s)`,
+			c.LineNodeLayer, c.NodeLayer, c.LineNodeLayer, c.LineLayer, c.LineNodeLayer, fidTblName),
+		fmt.Sprintf("INSERT OR IGNORE INTO %s (ogc_fid) SELECT node_fid FROM %s WHERE lines_fid IN (SELECT ogc_fid FROM %s)", nodeTblName, c.LineNodeLayer, fidTblName),
+		fmt.Sprintf("UPDATE %s SET intersections = %s, networks = (SELECT group_concat(network, ',') FROM (%s ORDER BY i)) WHERE ogc_fid IN (SELECT ogc_fid FROM %s)",
+			c.NodeLayer, strings.Join(strCounts, " + "), strings.Join(strNetworks, " UNION ALL "), nodeTblName),
+		fmt.Sprintf("DELETE FROM %s WHERE intersections = 0 AND ogc_fid IN (SELECT ogc_fid FROM %s)", c.NodeLayer, nodeTblName),
+	}
+	for _, strSql := range strSqls {
+		_, err := db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func createFidTable(tblName string, db *sql.DB) {
+	strSql := fmt.Sprintf("DROP TABLE IF EXISTS %s", tblName)
+	_, err := db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	strSql = fmt.Sprintf("CREATE TABLE %s (ogc_fid INTEGER PRIMARY KEY)", tblName)
+	_, err = db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func insertFids(tblName string, fids []int64, db *sql.DB) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	strSql := fmt.Sprintf("INSERT OR IGNORE INTO %s (ogc_fid) VALUES (?)", tblName)
+	stmt, err := tx.Prepare(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer stmt.Close()
+
+	for _, fid := range fids {
+		_, err := stmt.Exec(fid)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// fidList returns the ogc_fids as the list of an IN clause.
+func fidList(fids []int64) string {
+	if len(fids) == 0 {
+		return "NULL"
+	}
+
+	strFids := fmt.Sprint(fids[0])
+	for _, fid := range fids[1:] {
+		strFids += fmt.Sprintf(", %d", fid)
+	}
+	return strFids
+}
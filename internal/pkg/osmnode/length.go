@@ -0,0 +1,146 @@
+package osmnode
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkb"
+)
+
+// splitByLength subdivides the lines longer than MaxLength metres into even
+// pieces no longer than MaxLength. With srcName, a view of some lines of the
+// layer, only these lines are read.
+func splitByLength(c LinesSplitConfig, srcName string, db *sql.DB) {
+	log.Printf("Start split line longer than %g metres", c.MaxLength)
+
+	initLineage(c, db)
+	cs := c
+	if len(srcName) > 0 {
+		cs.LineLayer = srcName
+	}
+	tmpTblName := createTmpTable(cs, db)
+
+	strSql := fmt.Sprintf("SELECT ogc_fid, ST_AsBinary(GEOMETRY) FROM %s WHERE GEOMETRY IS NOT NULL", tmpTblName)
+	rows, err := db.Query(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	dist := distanceFunc(c.SRID, db)
+	w := newLineWriter(c, tmpTblName, db)
+	for rows.Next() {
+		var (
+			ogcFid   int64
+			geomData []byte
+		)
+		if err := rows.Scan(&ogcFid, &geomData); err != nil {
+			log.Fatalln(err)
+		}
+
+		geom, err := wkb.Unmarshal(geomData)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		l, ok := geom.(orb.LineString)
+		if !ok {
+			continue
+		}
+
+		segs := cutByLength(l, c.MaxLength, dist)
+		if len(segs) < 2 {
+			continue
+		}
+
+		res := splitResult{ogcFid: ogcFid}
+		for _, seg := range segs {
+			data, err := wkb.Marshal(seg.line)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			res.geoms = append(res.geoms, data)
+			res.ranges = append(res.ranges, [2]int{seg.from, seg.to})
+		}
+		w.write(res)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+	rows.Close()
+	w.close()
+
+	updateSegIndex(c, db)
+	dropTmpTable(tmpTblName, db)
+
+	log.Printf("Finished split line longer than %g metres, %d lines split", c.MaxLength, w.count)
+}
+
+// cutByLength cuts the line into the fewest pieces of equal length, measured by
+// dist, not longer than maxLength, a remainder within the tolerance adding no
+// piece. The cut points are interpolated on the edges. The from and to of a
+// piece are the original vertices it spans, an interpolated point counting as
+// the vertex before it for from and the one after it for to.
+func cutByLength(l orb.LineString, maxLength float64, dist func(orb.Point, orb.Point) float64) []segment {
+	const eps = 1e-6
+
+	dists := make([]float64, len(l)-1)
+	total := 0.0
+	for i := 1; i < len(l); i++ {
+		dists[i-1] = dist(l[i-1], l[i])
+		total += dists[i-1]
+	}
+
+	n := int(math.Ceil((total - eps) / maxLength))
+	if n < 2 {
+		return []segment{{line: l, from: 0, to: len(l) - 1}}
+	}
+	step := total / float64(n)
+
+	var (
+		line    orb.LineString
+		floors  []int
+		ceils   []int
+		cutIdxs []int
+	)
+	next := step
+	walked := 0.0
+	for i := 0; i < len(l)-1; i++ {
+		line = append(line, l[i])
+		floors = append(floors, i)
+		ceils = append(ceils, i)
+
+		for next < total-eps && next <= walked+dists[i]+eps {
+			t := 0.0
+			if dists[i] > 0 {
+				t = (next - walked) / dists[i]
+			}
+			switch {
+			case t < eps:
+				cutIdxs = append(cutIdxs, len(line)-1)
+			case t > 1-eps:
+				// Cut at the next vertex, added by the next iteration.
+				cutIdxs = append(cutIdxs, len(line))
+			default:
+				line = append(line, orb.Point{l[i][0] + t*(l[i+1][0]-l[i][0]), l[i][1] + t*(l[i+1][1]-l[i][1])})
+				floors = append(floors, i)
+				ceils = append(ceils, i+1)
+				cutIdxs = append(cutIdxs, len(line)-1)
+			}
+			next += step
+		}
+		walked += dists[i]
+	}
+	line = append(line, l[len(l)-1])
+	floors = append(floors, len(l)-1)
+	ceils = append(ceils, len(l)-1)
+
+	segs := cutLineString(line, cutIdxs)
+	for i := range segs {
+		segs[i].from = floors[segs[i].from]
+		segs[i].to = ceils[segs[i].to]
+	}
+
+	return segs
+}
@@ -0,0 +1,115 @@
+package osmnode
+
+import (
+	"math"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/planar"
+)
+
+// segmentsEqual compares the segments, their vertices within 1e-9.
+func segmentsEqual(a []segment, b []segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].from != b[i].from || a[i].to != b[i].to || len(a[i].line) != len(b[i].line) {
+			return false
+		}
+		for j, p := range a[i].line {
+			q := b[i].line[j]
+			if math.Abs(p[0]-q[0]) > 1e-9 || math.Abs(p[1]-q[1]) > 1e-9 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestCutByLength(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      orb.LineString
+		maxLength float64
+		dist      func(orb.Point, orb.Point) float64
+		want      []segment
+	}{
+		{
+			name:      "shorter than maxlength",
+			line:      orb.LineString{{0, 0}, {1, 0}},
+			maxLength: 2,
+			dist:      planar.Distance,
+			want:      []segment{{line: orb.LineString{{0, 0}, {1, 0}}, from: 0, to: 1}},
+		},
+		{
+			name:      "exact multiple of maxlength",
+			line:      orb.LineString{{0, 0}, {3, 0}},
+			maxLength: 1,
+			dist:      planar.Distance,
+			want: []segment{
+				{line: orb.LineString{{0, 0}, {1, 0}}, from: 0, to: 1},
+				{line: orb.LineString{{1, 0}, {2, 0}}, from: 0, to: 1},
+				{line: orb.LineString{{2, 0}, {3, 0}}, from: 0, to: 1},
+			},
+		},
+		{
+			name:      "cut on the vertices",
+			line:      orb.LineString{{0, 0}, {1, 0}, {2, 0}},
+			maxLength: 1,
+			dist:      planar.Distance,
+			want: []segment{
+				{line: orb.LineString{{0, 0}, {1, 0}}, from: 0, to: 1},
+				{line: orb.LineString{{1, 0}, {2, 0}}, from: 1, to: 2},
+			},
+		},
+		{
+			name:      "remainder shorter than the tolerance",
+			line:      orb.LineString{{0, 0}, {2 + 1e-9, 0}},
+			maxLength: 1,
+			dist:      planar.Distance,
+			want: []segment{
+				{line: orb.LineString{{0, 0}, {1, 0}}, from: 0, to: 1},
+				{line: orb.LineString{{1, 0}, {2 + 1e-9, 0}}, from: 0, to: 1},
+			},
+		},
+		{
+			name:      "remainder longer than the tolerance",
+			line:      orb.LineString{{0, 0}, {2.4, 0}},
+			maxLength: 1,
+			dist:      planar.Distance,
+			want: []segment{
+				{line: orb.LineString{{0, 0}, {0.8, 0}}, from: 0, to: 1},
+				{line: orb.LineString{{0.8, 0}, {1.6, 0}}, from: 0, to: 1},
+				{line: orb.LineString{{1.6, 0}, {2.4, 0}}, from: 0, to: 1},
+			},
+		},
+		{
+			name:      "planar length in degrees",
+			line:      orb.LineString{{0, 0}, {1, 0}},
+			maxLength: 50000,
+			dist:      planar.Distance,
+			want:      []segment{{line: orb.LineString{{0, 0}, {1, 0}}, from: 0, to: 1}},
+		},
+		{
+			name:      "geodesic length in metres",
+			line:      orb.LineString{{0, 0}, {1, 0}},
+			maxLength: 50000,
+			dist:      geo.Distance,
+			want: []segment{
+				{line: orb.LineString{{0, 0}, {1.0 / 3, 0}}, from: 0, to: 1},
+				{line: orb.LineString{{1.0 / 3, 0}, {2.0 / 3, 0}}, from: 0, to: 1},
+				{line: orb.LineString{{2.0 / 3, 0}, {1, 0}}, from: 0, to: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cutByLength(tt.line, tt.maxLength, tt.dist); !segmentsEqual(got, tt.want) {
+				t.Errorf("cutByLength() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package osmnode
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	OAT "navinfo.com/osmsqlitetools/internal/pkg/osmattr"
+)
+
+const memberLayer = "relation_members"
+
+// linkRelationLines maps the member ways of the relations imported in
+// relation_members to the split lines of the way, in member order and then
+// along the way, so routes (bus, hiking, E-roads) can be attached to the
+// lines.
+func linkRelationLines(c LinesSplitConfig, db *sql.DB) {
+	if len(c.RelationLineLayer) == 0 {
+		return
+	}
+	if !OAT.IsColExist(memberLayer, "member_id", db) {
+		log.Printf("No %s to link to %s", memberLayer, c.LineLayer)
+		return
+	}
+
+	log.Println("Start link relation members to lines")
+
+	strSegIndex := "NULL"
+	if OAT.IsColExist(c.LineLayer, "seg_index", db) {
+		strSegIndex = "l.seg_index"
+	}
+
+	strSqls := []string{
+		fmt.Sprintf("DROP TABLE IF EXISTS %s", c.RelationLineLayer),
+		fmt.Sprintf("CREATE TABLE %s (ogc_fid INTEGER PRIMARY KEY AUTOINCREMENT, relation_id BIGINT, seq INTEGER, role VARCHAR, lines_fid INTEGER, seg_index INTEGER)", c.RelationLineLayer),
+		fmt.Sprintf(`INSERT INTO %s (relation_id, seq, role, lines_fid, seg_index)
+			SELECT m.relation_id, m.seq, m.role, l.ogc_fid, %s FROM %s AS l JOIN %s AS m ON m.member_type = 'way' AND m.member_id = l.osm_id
+			ORDER BY m.relation_id, m.seq, %s`,
+			c.RelationLineLayer, strSegIndex, c.LineLayer, memberLayer, strSegIndex),
+		fmt.Sprintf("CREATE INDEX idx_%s_relation_id ON %s (relation_id)", c.RelationLineLayer, c.RelationLineLayer),
+		fmt.Sprintf("CREATE INDEX idx_%s_lines_fid ON %s (lines_fid)", c.RelationLineLayer, c.RelationLineLayer),
+	}
+	for _, strSql := range strSqls {
+		_, err := db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	log.Println("Finished link relation members to lines")
+}
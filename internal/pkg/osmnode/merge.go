@@ -0,0 +1,299 @@
+package osmnode
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkb"
+	OAT "navinfo.com/osmsqlitetools/internal/pkg/osmattr"
+)
+
+type mergeLine struct {
+	fid    int64
+	line   orb.LineString
+	attrs  string
+	oneway int
+	// origFid, fromVertex and toVertex are the lineage of the line, newLineage
+	// telling that the merged line spans several ways and starts its own.
+	origFid    int64
+	fromVertex int64
+	toVertex   int64
+	newLineage bool
+}
+
+func (l *mergeLine) from() orb.Point {
+	return l.line[0]
+}
+
+func (l *mergeLine) to() orb.Point {
+	return l.line[len(l.line)-1]
+}
+
+// mergeLines dissolves the pseudo nodes, where exactly two lines with the same
+// attributes meet, by joining the two lines into the one with the lower ogc_fid.
+// Without Fields or Tags the lines are compared by highway.
+func mergeLines(c LinesSplitConfig, db *sql.DB) {
+	log.Println("Start merge line at pseudo nodes")
+
+	if len(c.Fields) == 0 && len(c.Tags) == 0 {
+		if !OAT.IsColExist(c.LineLayer, "highway", db) {
+			log.Fatalf("Merge of %s needs the fields or tags to compare", c.LineLayer)
+		}
+		c.Fields = []string{"highway"}
+	}
+	lineage := OAT.IsColExist(c.LineLayer, "orig_fid", db)
+
+	lines := loadMergeLines(c, lineage, db)
+
+	incidents := make(map[orb.Point][]int64)
+	for fid, l := range lines {
+		incidents[l.from()] = append(incidents[l.from()], fid)
+		incidents[l.to()] = append(incidents[l.to()], fid)
+	}
+
+	splitPnts := loadSplitPoints(c, db)
+
+	pnts := make([]orb.Point, 0, len(incidents))
+	for p, fids := range incidents {
+		if len(fids) == 2 && fids[0] != fids[1] && !splitPnts[p] {
+			pnts = append(pnts, p)
+		}
+	}
+	sort.Slice(pnts, func(i, j int) bool {
+		if pnts[i][0] != pnts[j][0] {
+			return pnts[i][0] < pnts[j][0]
+		}
+		return pnts[i][1] < pnts[j][1]
+	})
+
+	merged := make(map[int64]bool)
+	deleted := make(map[int64]bool)
+	for _, p := range pnts {
+		fids := incidents[p]
+		if len(fids) != 2 || fids[0] == fids[1] {
+			continue
+		}
+
+		a, b := lines[fids[0]], lines[fids[1]]
+		if b.fid < a.fid {
+			a, b = b, a
+		}
+		if !joinLines(a, b, p) {
+			continue
+		}
+		mergeLineage(a, b)
+
+		far := b.to()
+		if far == p {
+			far = b.from()
+		}
+		for i, fid := range incidents[far] {
+			if fid == b.fid {
+				incidents[far][i] = a.fid
+				break
+			}
+		}
+		delete(incidents, p)
+		delete(lines, b.fid)
+
+		merged[a.fid] = true
+		deleted[b.fid] = true
+		delete(merged, b.fid)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	strSql := fmt.Sprintf("UPDATE %s SET GEOMETRY = GeomFromWKB(?, %d) WHERE ogc_fid = ?", c.LineLayer, c.SRID)
+	if lineage {
+		strSql = fmt.Sprintf("UPDATE %s SET GEOMETRY = GeomFromWKB(?, %d), orig_fid = ?, from_vertex = ?, to_vertex = ? WHERE ogc_fid = ?", c.LineLayer, c.SRID)
+	}
+	stmtUpd, err := tx.Prepare(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer stmtUpd.Close()
+
+	strSql = fmt.Sprintf("DELETE FROM %s WHERE ogc_fid = ?", c.LineLayer)
+	stmtDel, err := tx.Prepare(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer stmtDel.Close()
+
+	for fid := range merged {
+		l := lines[fid]
+		data, err := wkb.Marshal(l.line)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if lineage {
+			if l.newLineage {
+				l.origFid, l.fromVertex, l.toVertex = fid, 0, int64(len(l.line)-1)
+			}
+			_, err = stmtUpd.Exec(data, l.origFid, l.fromVertex, l.toVertex, fid)
+		} else {
+			_, err = stmtUpd.Exec(data, fid)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	for fid := range deleted {
+		_, err := stmtDel.Exec(fid)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if lineage {
+		updateSegIndex(c, db)
+	}
+
+	log.Printf("Finished merge line at pseudo nodes, %d lines merged into %d", len(deleted)+len(merged), len(merged))
+}
+
+// joinLines appends b to a at the shared point p. The lines are only joined
+// when their attributes match and, for oneway lines, the travel direction of b
+// stays the same in the orientation of a.
+func joinLines(a *mergeLine, b *mergeLine, p orb.Point) bool {
+	if a.attrs != b.attrs {
+		return false
+	}
+
+	bLine := b.line
+	reversed := false
+	if (a.to() == p && b.to() == p) || (a.from() == p && b.from() == p) {
+		bLine = reverseLine(b.line)
+		reversed = true
+	}
+
+	bOneway := b.oneway
+	if reversed {
+		bOneway = -bOneway
+	}
+	if bOneway != a.oneway {
+		return false
+	}
+
+	var line orb.LineString
+	if a.to() == p {
+		line = append(line, a.line...)
+		line = append(line, bLine[1:]...)
+	} else {
+		line = append(line, bLine[:len(bLine)-1]...)
+		line = append(line, a.line...)
+	}
+	a.line = line
+
+	return true
+}
+
+// mergeLineage extends the vertex range of a when b is the next or previous
+// segment of the same way, and otherwise starts a new lineage at a, as the
+// merged line then spans several ways.
+func mergeLineage(a *mergeLine, b *mergeLine) {
+	if !a.newLineage && !b.newLineage && a.origFid == b.origFid && (a.toVertex == b.fromVertex || b.toVertex == a.fromVertex) {
+		a.fromVertex = min(a.fromVertex, b.fromVertex)
+		a.toVertex = max(a.toVertex, b.toVertex)
+		return
+	}
+	a.newLineage = true
+}
+
+func reverseLine(l orb.LineString) orb.LineString {
+	r := make(orb.LineString, len(l))
+	for i, p := range l {
+		r[len(l)-1-i] = p
+	}
+	return r
+}
+
+func loadMergeLines(c LinesSplitConfig, lineage bool, db *sql.DB) map[int64]*mergeLine {
+	strLineage := "NULL, NULL, NULL"
+	if lineage {
+		strLineage = "orig_fid, from_vertex, to_vertex"
+	}
+	strCols := ""
+	for _, f := range c.Fields {
+		strCols += fmt.Sprintf(", CAST(%s AS TEXT)", f)
+	}
+	strTags := "NULL"
+	if len(c.Tags) > 0 && OAT.IsColExist(c.LineLayer, "other_tags", db) {
+		strTags = "other_tags"
+	}
+
+	strSql := fmt.Sprintf("SELECT ogc_fid, ST_AsBinary(GEOMETRY), %s, %s%s FROM %s WHERE GEOMETRY IS NOT NULL", strLineage, strTags, strCols, c.LineLayer)
+	rows, err := db.Query(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	lines := make(map[int64]*mergeLine)
+	for rows.Next() {
+		var (
+			fid      int64
+			geomData []byte
+			origFid  sql.NullInt64
+			from     sql.NullInt64
+			to       sql.NullInt64
+			tags     sql.NullString
+		)
+		vals := make([]sql.NullString, len(c.Fields))
+		dest := []any{&fid, &geomData, &origFid, &from, &to, &tags}
+		for i := range vals {
+			dest = append(dest, &vals[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			log.Fatalln(err)
+		}
+
+		geom, err := wkb.Unmarshal(geomData)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		l, ok := geom.(orb.LineString)
+		if !ok || len(l) < 2 {
+			continue
+		}
+
+		attrs := make([]string, 0, len(vals)+len(c.Tags))
+		for _, v := range vals {
+			attrs = append(attrs, fmt.Sprintf("%t:%s", v.Valid, v.String))
+		}
+		m := OAT.ParseTags(tags.String)
+		for _, t := range c.Tags {
+			v, ok := m[t]
+			attrs = append(attrs, fmt.Sprintf("%t:%s", ok, v))
+		}
+
+		ml := &mergeLine{fid: fid, line: l, attrs: strings.Join(attrs, "\x00"), origFid: fid, toVertex: int64(len(l) - 1)}
+		if origFid.Valid && from.Valid && to.Valid {
+			ml.origFid, ml.fromVertex, ml.toVertex = origFid.Int64, from.Int64, to.Int64
+		}
+		lines[fid] = ml
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	for fid, dir := range loadOneways(c.LineLayer, db) {
+		if l, ok := lines[fid]; ok {
+			l.oneway = dir
+		}
+	}
+
+	return lines
+}
@@ -0,0 +1,132 @@
+package osmnode
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// networkPeers returns the configs of the other networks which share the node
+// layer of c.
+func networkPeers(cs []LinesSplitConfig, c LinesSplitConfig) []LinesSplitConfig {
+	peers := []LinesSplitConfig{}
+	for _, p := range cs {
+		if p.NodeLayer == c.NodeLayer && p.LineLayer != c.LineLayer {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// addNetworkPoints marks the vertices of the lines lying on a vertex of a line
+// of the peer networks as intersections, so the lines are also cut where the
+// networks connect, as at a level crossing or a ferry terminal.
+func addNetworkPoints(c LinesSplitConfig, peers []LinesSplitConfig, db *sql.DB) {
+	for _, p := range peers {
+		strSql := fmt.Sprintf(`UPDATE %s SET intersections = intersections + 1 WHERE GEOMETRY IN (
+			WITH RECURSIVE v(GEOMETRY, i, geom) AS (
+				SELECT GEOMETRY, 0, NULL FROM %s
+				UNION ALL
+				SELECT GEOMETRY, i+1, ST_PointN(GEOMETRY, i+1) FROM v WHERE i < ST_NumPoints(GEOMETRY)
+			)
+			SELECT %s FROM v WHERE geom IS NOT NULL)`,
+			c.LineNodeLayer, p.LineLayer, geomCol(p.LineLayer, "geom", c.SRID, db))
+		_, err := db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// sharedNodeGroups returns the configs grouped by node layer, for the node
+// layers shared by several line layers. A line layer configured more than once
+// is represented by its last config.
+func sharedNodeGroups(cs []LinesSplitConfig) [][]LinesSplitConfig {
+	groups := [][]LinesSplitConfig{}
+	index := map[string]int{}
+	for _, c := range cs {
+		// An incremental config updates the node layer in place.
+		if c.Mode == "incremental" {
+			continue
+		}
+
+		i, ok := index[c.NodeLayer]
+		if !ok {
+			i = len(groups)
+			index[c.NodeLayer] = i
+			groups = append(groups, []LinesSplitConfig{})
+		}
+
+		replaced := false
+		for j, m := range groups[i] {
+			if m.LineLayer == c.LineLayer {
+				groups[i][j] = c
+				replaced = true
+			}
+		}
+		if !replaced {
+			groups[i] = append(groups[i], c)
+		}
+	}
+
+	shared := [][]LinesSplitConfig{}
+	for _, g := range groups {
+		if len(g) > 1 {
+			shared = append(shared, g)
+		}
+	}
+	return shared
+}
+
+// unifyNodes rebuilds the node layer shared by the networks from the endpoints
+// of all their lines, relinks the line nodes of each network to it and lists
+// the networks touching each node in networks.
+func unifyNodes(g []LinesSplitConfig, db *sql.DB) {
+	log.Printf("Start unify node %s", g[0].NodeLayer)
+
+	c := g[0]
+	createNodeTable(c, db)
+
+	strEnds := make([]string, 0, len(g)*2)
+	for _, m := range g {
+		strGeom := geomCol(m.LineLayer, "GEOMETRY", c.SRID, db)
+		strEnds = append(strEnds,
+			fmt.Sprintf("SELECT ST_StartPoint(%s) AS geom FROM %s", strGeom, m.LineLayer),
+			fmt.Sprintf("SELECT ST_EndPoint(%s) AS geom FROM %s", strGeom, m.LineLayer))
+	}
+	strSql := fmt.Sprintf("INSERT INTO %s (intersections, GEOMETRY) SELECT COUNT(*), geom FROM (%s) WHERE geom IS NOT NULL GROUP BY geom", c.NodeLayer, strings.Join(strEnds, " UNION ALL "))
+	_, err := db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	createNodeIndex(c, db)
+
+	splitLayers := []SplitLayer{}
+	for _, m := range g {
+		strGeom := geomCol(m.LineLayer, "l.GEOMETRY", c.SRID, db)
+		strSql = fmt.Sprintf(`UPDATE %s SET node_fid = (SELECT n.ogc_fid FROM %s AS n WHERE n.GEOMETRY = (
+			SELECT CASE WHEN %s.pos_type = 1 THEN ST_StartPoint(%s) ELSE ST_EndPoint(%s) END FROM %s AS l WHERE l.ogc_fid = %s.lines_fid))`,
+			m.LineNodeLayer, c.NodeLayer, m.LineNodeLayer, strGeom, strGeom, m.LineLayer, m.LineNodeLayer)
+		_, err = db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		strSql = fmt.Sprintf("UPDATE %s SET networks = CASE WHEN networks IS NULL THEN '%s' ELSE networks || ',%s' END WHERE ogc_fid IN (SELECT node_fid FROM %s)",
+			c.NodeLayer, m.network(), m.network(), m.LineNodeLayer)
+		_, err = db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		splitLayers = append(splitLayers, m.SplitLayers...)
+	}
+
+	c.SplitLayers = splitLayers
+	linkSplitPoints(c, db)
+	classifyNodes(g, db)
+
+	log.Printf("Finished unify node %s", g[0].NodeLayer)
+}
@@ -0,0 +1,210 @@
+package osmnode
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	OAT "navinfo.com/osmsqlitetools/internal/pkg/osmattr"
+)
+
+// outsidePolygon stands for the area outside the polygons of the polygon mode.
+const outsidePolygon int64 = -1
+
+type lineClass struct {
+	highway    string
+	roundabout bool
+	// inPolygons is set when the layer was split by polygons, a NULL
+	// polygonFid then being outside of them.
+	inPolygons bool
+	polygonFid sql.NullInt64
+}
+
+// lineKey identifies a line by the index of its config and its ogc_fid, as the
+// lines of several networks can share a node layer.
+type lineKey [2]int64
+
+type nodeInfo struct {
+	lines      map[lineKey]bool
+	ins        map[lineKey]bool
+	outs       map[lineKey]bool
+	loop       bool
+	classes    map[string]bool
+	roundabout bool
+	other      bool
+	polygons   map[int64]bool
+}
+
+// classifyNodes writes the degree of each node, as the number of distinct
+// lines at it, the in and out degree following the oneway direction, the road
+// classes of the lines and the node type:
+//   - dead_end: a single line, which is not a loop, ends at the node
+//   - roundabout_entry: a roundabout meets another line
+//   - boundary: the lines lie in different polygons of the polygon mode, or
+//     inside and outside of one
+//   - junction: three or more lines meet
+//   - pseudo: two lines meet, or a loop closes on itself
+//
+// The configs share the node layer, the lines of all of them are counted.
+func classifyNodes(cs []LinesSplitConfig, db *sql.DB) {
+	log.Println("Start classify node")
+
+	nodes := make(map[int64]*nodeInfo)
+	info := func(fid int64) *nodeInfo {
+		n, ok := nodes[fid]
+		if !ok {
+			n = &nodeInfo{
+				lines:    map[lineKey]bool{},
+				ins:      map[lineKey]bool{},
+				outs:     map[lineKey]bool{},
+				classes:  map[string]bool{},
+				polygons: map[int64]bool{},
+			}
+			nodes[fid] = n
+		}
+		return n
+	}
+
+	for i, c := range cs {
+		lines := loadLineEnds(c.LineLayer, c.LineNodeLayer, true, db)
+		classes := loadLineClasses(c, db)
+
+		for fid, l := range lines {
+			key := lineKey{int64(i), fid}
+			cls := classes[fid]
+			for _, end := range []struct {
+				node int64
+				last bool
+			}{{l.from, false}, {l.to, true}} {
+				n := info(end.node)
+				n.lines[key] = true
+				if l.from == l.to {
+					n.loop = true
+				}
+
+				// A line is entered at its last point and left at its first one.
+				if l.oneway == 0 || (l.oneway > 0) == end.last {
+					n.ins[key] = true
+				}
+				if l.oneway == 0 || (l.oneway > 0) != end.last {
+					n.outs[key] = true
+				}
+
+				if len(cls.highway) > 0 {
+					n.classes[cls.highway] = true
+				}
+				if cls.roundabout {
+					n.roundabout = true
+				} else {
+					n.other = true
+				}
+				if cls.polygonFid.Valid {
+					n.polygons[cls.polygonFid.Int64] = true
+				} else if cls.inPolygons {
+					n.polygons[outsidePolygon] = true
+				}
+			}
+		}
+	}
+
+	c := cs[0]
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	strSql := fmt.Sprintf("UPDATE %s SET degree = ?, in_degree = ?, out_degree = ?, road_classes = ?, node_type = ? WHERE ogc_fid = ?", c.NodeLayer)
+	stmt, err := tx.Prepare(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer stmt.Close()
+
+	counts := map[string]int{}
+	for fid, n := range nodes {
+		strClasses := make([]string, 0, len(n.classes))
+		for cls := range n.classes {
+			strClasses = append(strClasses, cls)
+		}
+		sort.Strings(strClasses)
+
+		nodeType := n.nodeType()
+		counts[nodeType]++
+
+		_, err := stmt.Exec(len(n.lines), len(n.ins), len(n.outs), strings.Join(strClasses, ","), nodeType, fid)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	log.Printf("Finished classify node, %v", counts)
+}
+
+func (n *nodeInfo) nodeType() string {
+	switch {
+	case len(n.lines) == 1 && !n.loop:
+		return "dead_end"
+	case n.roundabout && n.other:
+		return "roundabout_entry"
+	case len(n.polygons) > 1:
+		return "boundary"
+	case len(n.lines) >= 3:
+		return "junction"
+	default:
+		return "pseudo"
+	}
+}
+
+func loadLineClasses(c LinesSplitConfig, db *sql.DB) map[int64]lineClass {
+	strHighway := "NULL"
+	if OAT.IsColExist(c.LineLayer, "highway", db) {
+		strHighway = "highway"
+	}
+	strTags := "NULL"
+	if OAT.IsColExist(c.LineLayer, "other_tags", db) {
+		strTags = "other_tags"
+	}
+	strPolygon := "NULL"
+	col := fmt.Sprintf("%s_fid", c.polygonPrefix())
+	inPolygons := OAT.IsColExist(c.LineLayer, col, db)
+	if inPolygons {
+		strPolygon = col
+	}
+
+	strSql := fmt.Sprintf("SELECT ogc_fid, %s, %s, %s FROM %s", strHighway, strTags, strPolygon, c.LineLayer)
+	rows, err := db.Query(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	classes := make(map[int64]lineClass)
+	for rows.Next() {
+		var (
+			fid     int64
+			highway sql.NullString
+			tags    sql.NullString
+			cls     lineClass
+		)
+		if err := rows.Scan(&fid, &highway, &tags, &cls.polygonFid); err != nil {
+			log.Fatalln(err)
+		}
+
+		cls.highway = highway.String
+		cls.inPolygons = inPolygons
+		cls.roundabout = OAT.ParseTags(tags.String)["junction"] == "roundabout"
+		classes[fid] = cls
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	return classes
+}
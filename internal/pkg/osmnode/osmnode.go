@@ -5,11 +5,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
 
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/paulmach/orb"
-	"github.com/paulmach/orb/encoding/wkb"
-	"github.com/paulmach/orb/encoding/wkt"
 	"gopkg.in/yaml.v3"
 )
 
@@ -21,6 +19,49 @@ type LinesSplitConfig struct {
 	LineLayer     string
 	LineNodeLayer string
 	NodeLayer     string
+	// Mode is "split" (default), "merge" to dissolve the pseudo nodes or
+	// "polygon" to split at the boundaries of the polygons of PolygonLayer.
+	// "incremental" re-splits only the lines of Inserted, Updated and Deleted,
+	// by ogc_fid in the split line layer, and their neighbours.
+	Mode     string
+	Inserted []int64
+	Updated  []int64
+	Deleted  []int64
+	// Fields and Tags are the columns and other_tags keys which must be equal
+	// for two lines to be merged, highway when none is set.
+	Fields []string
+	Tags   []string
+	// Workers is the number of goroutines cutting the lines, the number of CPUs by default.
+	Workers int
+	// SplitLayers are the point layers at which the lines are split too, the
+	// nodes being linked to the points in PointLinkLayer, <nodelayer>_points
+	// by default. In merge mode no line is merged at these points.
+	SplitLayers    []SplitLayer
+	PointLinkLayer string
+	// PolygonFields of the polygon containing a segment are written to the
+	// <polygonprefix>_<field> columns, with its ogc_fid in <polygonprefix>_fid.
+	PolygonLayer  SplitLayer
+	PolygonFields []string
+	PolygonPrefix string
+	// MaxLength in metres subdivides the longer segments evenly after splitting.
+	MaxLength float64
+	// Network names the lines in the networks column of the nodes, the line
+	// layer by default. Configs of different line layers sharing a node layer
+	// are split at each other's vertices and get a unified node layer.
+	Network string
+	// RelationLineLayer maps the member ways of the imported relations to the
+	// split lines, by relation_id and seq of relation_members.
+	RelationLineLayer string
+	// SRID of the line layer, read from geometry_columns when not set. With
+	// Transform the line layer is first copied to TransformLayer,
+	// <linelayer>_<transform> by default, reprojected to that SRID, e.g. a UTM
+	// zone, and the copy is split, the outputs then being written in it.
+	SRID           int
+	Transform      int
+	TransformLayer string
+	// sourceLayer is the imported layer of a transformed LineLayer, whose
+	// changed lines an incremental run copies again.
+	sourceLayer string
 }
 
 func loadConfigs(filename string) LinesSplitConfigs {
@@ -74,144 +115,60 @@ func createTmpTable(c LinesSplitConfig, db *sql.DB) string {
 
 func SplitLines(strConfigFileName string, db *sql.DB) {
 	conf := loadConfigs(strConfigFileName)
+	// The peers of a network are read with their reprojected layers.
+	for i := range conf.Configs {
+		resolveSRID(&conf.Configs[i], db)
+	}
 	for _, c := range conf.Configs {
-		createLineNode(c, db, false)
-
-		tmpTblName := createTmpTable(c, db)
-
-		strSql := fmt.Sprintf("SELECT lines_fid, order_id FROM %s WHERE intersections > 1 AND pos_type = 0 ORDER BY lines_fid ASC, order_id ASC", c.LineNodeLayer)
-		rowsNodes, err := db.Query(strSql)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		defer rowsNodes.Close()
-
-		tx, err := db.Begin()
-		if err != nil {
-			log.Fatalln(err)
-		}
-
-		lastRFID := int64(-1)
-
-		var (
-			rfID     int64
-			orderIDs []int
-		)
-
-		log.Println("Start split line with intersection nodes")
-
-		strCols := getColsSql(tmpTblName, db)
-		for rowsNodes.Next() {
-			var (
-				orderID int
-			)
-			if err := rowsNodes.Scan(&rfID, &orderID); err != nil {
-				log.Fatal(err)
-			}
-			if lastRFID == -1 {
-				lastRFID = rfID
-			}
-
-			if lastRFID != rfID {
-				split(lastRFID, orderIDs, strCols, tmpTblName, c, db, tx)
-				lastRFID = rfID
-				orderIDs = []int{}
-				orderIDs = append(orderIDs, orderID)
-			} else {
-				orderIDs = append(orderIDs, orderID)
-			}
+		if c.Mode == "incremental" {
+			resplitLines(c, networkPeers(conf.Configs, c), db)
+			continue
 		}
 
-		split(rfID, orderIDs, strCols, tmpTblName, c, db, tx)
-
-		if err := rowsNodes.Err(); err != nil {
-			log.Fatalln(err)
+		switch c.Mode {
+		case "merge":
+			mergeLines(c, db)
+		case "polygon":
+			splitByPolygons(c, db)
+		default:
+			splitByNodes(c, networkPeers(conf.Configs, c), db)
 		}
-
-		err = tx.Commit()
-		if err != nil {
-			log.Fatalln(err)
+		if c.MaxLength > 0 && c.Mode != "merge" {
+			splitByLength(c, "", db)
 		}
 
-		log.Println("Finished split line with intersection nodes")
-
-		dropTmpTable(tmpTblName, db)
 		createLineNode(c, db, true)
 		createNode(c, db)
 		createNodeRef(c, db)
-	}
-}
-
-func split(ogcFid int64, pntIDs []int, strCols string, tblName string, c LinesSplitConfig, db *sql.DB, tx *sql.Tx) {
-	strSql := fmt.Sprintf("SELECT ST_AsBinary(ST_DissolvePoints(GEOMETRY)) FROM %s WHERE ogc_fid=?", tblName)
-	row := db.QueryRow(strSql, ogcFid)
-	if row.Err() != nil {
-		log.Fatalln(row.Err())
-	}
-
-	var geomData []byte
-	if err := row.Scan(&geomData); err != nil {
-		log.Fatalln(err)
-	}
-
-	geom, err := wkb.Unmarshal(geomData)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	mp, ok := geom.(orb.MultiPoint)
-	if !ok {
-		log.Fatalln("Geometry is not a MultiLineString or LineString")
-		return
+		linkSplitPoints(c, db)
+		classifyNodes([]LinesSplitConfig{c}, db)
+		linkRelationLines(c, db)
 	}
 
-	var splitPnts orb.MultiPoint
-	for _, id := range pntIDs {
-		splitPnts = append(splitPnts, mp[id-1])
+	for _, g := range sharedNodeGroups(conf.Configs) {
+		unifyNodes(g, db)
 	}
-
-	splitLine(ogcFid, splitPnts, strCols, tblName, c, db, tx)
 }
 
-func splitLine(ogcFid int64, points orb.MultiPoint, strCols string, tblName string, c LinesSplitConfig, db *sql.DB, tx *sql.Tx) {
-	strMp := wkt.MarshalString(points)
-
-	strSql := fmt.Sprintf("SELECT ST_AsBinary(ST_LinesCutAtNodes(GEOMETRY, GeomFromText(?, 4326))) FROM %s WHERE ogc_fid == ?", tblName)
-	row := db.QueryRow(strSql, strMp, ogcFid)
-	if row.Err() != nil {
-		log.Fatalln(row.Err())
+func (c LinesSplitConfig) network() string {
+	if len(c.Network) > 0 {
+		return c.Network
 	}
+	return c.LineLayer
+}
 
-	var geomData []byte
-	if err := row.Scan(&geomData); err != nil {
-		log.Fatalln(err)
-	}
+func splitByNodes(c LinesSplitConfig, peers []LinesSplitConfig, db *sql.DB) {
+	createLineNode(c, db, false)
+	addSplitPoints(c, db)
+	addNetworkPoints(c, peers, db)
+	initLineage(c, db)
 
-	geom, err := wkb.Unmarshal(geomData)
-	if err != nil {
-		log.Fatalln(err)
-	}
+	tmpTblName := createTmpTable(c, db)
 
-	ml, ok := geom.(orb.MultiLineString)
-	if !ok {
-		//log.Fatalln("Geometry is not a MultiLineString or LineString")
-		return
-	}
+	splitLines(c, tmpTblName, db)
+	updateSegIndex(c, db)
 
-	for i, l := range ml {
-		err := error(nil)
-		strMl := wkt.MarshalString(l)
-		if i == 0 {
-			strSql := fmt.Sprintf("UPDATE %s SET GEOMETRY = GeomFromText(?, 4326) WHERE ogc_fid = ?", c.LineLayer)
-			_, err = tx.Exec(strSql, strMl, ogcFid)
-		} else {
-			strSql := fmt.Sprintf(`INSERT INTO %s (%s, GEOMETRY) SELECT %s, GeomFromText(?, 4326) AS GEOMETRY FROM %s WHERE ogc_fid = ?`, c.LineLayer, strCols, strCols, tblName)
-			_, err = tx.Exec(strSql, strMl, ogcFid)
-		}
-		if err != nil {
-			log.Fatalln(err)
-		}
-	}
+	dropTmpTable(tmpTblName, db)
 }
 
 func createLineNode(c LinesSplitConfig, db *sql.DB, createOnlyEndpoint bool) {
@@ -227,7 +184,7 @@ func createLineNode(c LinesSplitConfig, db *sql.DB, createOnlyEndpoint bool) {
 	if err != nil {
 		log.Fatalln(err)
 	}
-	strSql = fmt.Sprintf("SELECT AddGeometryColumn('%s', '%s', 4326, 'POINT', 'XY', 1)", c.LineNodeLayer, "GEOMETRY")
+	strSql = fmt.Sprintf("SELECT AddGeometryColumn('%s', '%s', %d, 'POINT', 'XY', 1)", c.LineNodeLayer, "GEOMETRY", c.SRID)
 	_, err = db.Exec(strSql)
 	if err != nil {
 		log.Fatalln(err)
@@ -238,13 +195,13 @@ func createLineNode(c LinesSplitConfig, db *sql.DB, createOnlyEndpoint bool) {
 			WITH RECURSIVE nodes (ogc_fid, osm_id, num, order_id, geom) AS (
 				SELECT ogc_fid, osm_id, ST_NumPoints(GEOMETRY), 1, ST_PointN(GEOMETRY, 1) AS geom FROM %s
 			UNION ALL
-				SELECT ogc_fid, osm_id, ST_NumPoints(GEOMETRY), ST_NumPoints(GEOMETRY), ST_PointN(GEOMETRY, ST_NumPoints(GEOMETRY)) AS geom FROM lines
+				SELECT ogc_fid, osm_id, ST_NumPoints(GEOMETRY), ST_NumPoints(GEOMETRY), ST_PointN(GEOMETRY, ST_NumPoints(GEOMETRY)) AS geom FROM %s
 			)
 			INSERT INTO %s (lines_fid, osm_id, order_id, pos_type, GEOMETRY)
 				SELECT ogc_fid AS lines_fid, osm_id, order_id,
 					CASE WHEN order_id == 1 THEN 1 WHEN order_id == num THEN 2 ELSE 0 END pos_type,
 					geom AS GEOMETRY FROM nodes WHERE geom IS NOT NULL ORDER BY ogc_fid, order_id`,
-			c.LineLayer, c.LineNodeLayer)
+			c.LineLayer, c.LineLayer, c.LineNodeLayer)
 	} else {
 		strSql = fmt.Sprintf(`
 			WITH RECURSIVE nodes(ogc_fid, osm_id, GEOMETRY, i, geom) AS (
@@ -264,12 +221,12 @@ func createLineNode(c LinesSplitConfig, db *sql.DB, createOnlyEndpoint bool) {
 		log.Fatalln(err)
 	}
 
-	strSql = fmt.Sprintf("CREATE INDEX idx_osm_id ON %s (osm_id ASC)", c.LineNodeLayer)
+	strSql = fmt.Sprintf("CREATE INDEX idx_%s_osm_id ON %s (osm_id ASC)", c.LineNodeLayer, c.LineNodeLayer)
 	_, err = db.Exec(strSql)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	strSql = fmt.Sprintf("CREATE INDEX idx_ln_geo ON %s (GEOMETRY ASC)", c.LineNodeLayer)
+	strSql = fmt.Sprintf("CREATE INDEX idx_%s_geo ON %s (GEOMETRY ASC)", c.LineNodeLayer, c.LineNodeLayer)
 	_, err = db.Exec(strSql)
 	if err != nil {
 		log.Fatalln(err)
@@ -291,28 +248,40 @@ func createLineNode(c LinesSplitConfig, db *sql.DB, createOnlyEndpoint bool) {
 func createNode(c LinesSplitConfig, db *sql.DB) {
 	log.Println("Start create node")
 
-	strSql := fmt.Sprintf("SELECT DropGeoTable('%s')", c.NodeLayer)
+	createNodeTable(c, db)
+
+	strSql := fmt.Sprintf(`INSERT INTO %s (intersections, networks, GEOMETRY) SELECT intersections, '%s', GEOMETRY FROM %s GROUP BY GEOMETRY`, c.NodeLayer, c.network(), c.LineNodeLayer)
 	_, err := db.Exec(strSql)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	strSql = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (ogc_fid INTEGER PRIMARY KEY AUTOINCREMENT, intersections INTEGER)", c.NodeLayer)
-	_, err = db.Exec(strSql)
+
+	createNodeIndex(c, db)
+
+	log.Println("Finished create node")
+}
+
+func createNodeTable(c LinesSplitConfig, db *sql.DB) {
+	strSql := fmt.Sprintf("SELECT DropGeoTable('%s')", c.NodeLayer)
+	_, err := db.Exec(strSql)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	strSql = fmt.Sprintf("SELECT AddGeometryColumn('%s', '%s', 4326, 'POINT', 'XY', 1)", c.NodeLayer, "GEOMETRY")
+	strSql = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (ogc_fid INTEGER PRIMARY KEY AUTOINCREMENT, intersections INTEGER, networks VARCHAR, degree INTEGER, in_degree INTEGER, out_degree INTEGER, road_classes VARCHAR, node_type VARCHAR)", c.NodeLayer)
 	_, err = db.Exec(strSql)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	strSql = fmt.Sprintf(`INSERT INTO %s (intersections, GEOMETRY) SELECT intersections, GEOMETRY FROM %s GROUP BY GEOMETRY`, c.NodeLayer, c.LineNodeLayer)
+	strSql = fmt.Sprintf("SELECT AddGeometryColumn('%s', '%s', %d, 'POINT', 'XY', 1)", c.NodeLayer, "GEOMETRY", c.SRID)
 	_, err = db.Exec(strSql)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	strSql = fmt.Sprintf("CREATE INDEX idx_nodes_geo ON %s (GEOMETRY ASC)", c.NodeLayer)
-	_, err = db.Exec(strSql)
+}
+
+func createNodeIndex(c LinesSplitConfig, db *sql.DB) {
+	strSql := fmt.Sprintf("CREATE INDEX idx_%s_geo ON %s (GEOMETRY ASC)", c.NodeLayer, c.NodeLayer)
+	_, err := db.Exec(strSql)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -321,8 +290,6 @@ func createNode(c LinesSplitConfig, db *sql.DB) {
 	if err != nil {
 		log.Fatalln(err)
 	}
-
-	log.Println("Finished create node")
 }
 
 func createNodeRef(c LinesSplitConfig, db *sql.DB) {
@@ -346,7 +313,7 @@ func createNodeRef(c LinesSplitConfig, db *sql.DB) {
 		log.Fatalln(err)
 	}
 
-	strSql = fmt.Sprintf("DROP INDEX %s", "idx_ln_geo")
+	strSql = fmt.Sprintf("DROP INDEX idx_%s_geo", c.LineNodeLayer)
 	_, err = db.Exec(strSql)
 	if err != nil {
 		log.Fatalln(err)
@@ -371,7 +338,7 @@ func createNodeRef(c LinesSplitConfig, db *sql.DB) {
 	log.Println("Finished create ref between line and node")
 }
 
-func getColsSql(tblName string, db *sql.DB) (strCols string) {
+func getColsSql(tblName string, db *sql.DB, excludes ...string) (strCols string) {
 	strSql := fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", tblName)
 	rows, err := db.Query(strSql)
 	if err != nil {
@@ -390,6 +357,8 @@ func getColsSql(tblName string, db *sql.DB) (strCols string) {
 		} else if strCol == "GEOMETRY" {
 			//strCol = "AsBinary(GEOMETRY)"
 			continue
+		} else if slices.Contains(excludes, strCol) {
+			continue
 		}
 
 		if len(strCols) == 0 {
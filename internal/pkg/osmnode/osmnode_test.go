@@ -0,0 +1,317 @@
+package osmnode
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var registerSpatialite sync.Once
+
+// openSpatialite opens a new database in the test directory with spatialite
+// loaded, skipping the test when mod_spatialite is not installed.
+func openSpatialite(tb testing.TB) *sql.DB {
+	tb.Helper()
+
+	registerSpatialite.Do(func() {
+		sql.Register("sqlite3_test_spatialite", &sqlite3.SQLiteDriver{
+			Extensions: []string{"mod_spatialite"},
+		})
+	})
+
+	strSql := "file:" + filepath.Join(tb.TempDir(), "test.sqlite") + "?cache=shared&mode=rwc&_fk=1"
+	db, err := sql.Open("sqlite3_test_spatialite", strSql)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		tb.Skipf("spatialite is not available: %v", err)
+	}
+	tb.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// createLineLayer creates a spatialite line layer as imported by ogr2ogr, with
+// one line per WKT and a spatial index.
+func createLineLayer(t *testing.T, tblName string, field string, value string, lines []string, db *sql.DB) {
+	t.Helper()
+
+	strSqls := []string{
+		"CREATE TABLE " + tblName + " (ogc_fid INTEGER PRIMARY KEY AUTOINCREMENT, osm_id VARCHAR, " + field + " VARCHAR, other_tags VARCHAR)",
+		"SELECT AddGeometryColumn('" + tblName + "', 'GEOMETRY', 4326, 'LINESTRING', 'XY')",
+		"SELECT CreateSpatialIndex('" + tblName + "', 'GEOMETRY')",
+	}
+	for _, strSql := range strSqls {
+		if _, err := db.Exec(strSql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, l := range lines {
+		strSql := "INSERT INTO " + tblName + " (osm_id, " + field + ", GEOMETRY) VALUES (?, ?, GeomFromText(?, 4326))"
+		if _, err := db.Exec(strSql, i+1, value, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSplitLinesTwoNetworks(t *testing.T) {
+	db := openSpatialite(t)
+	if _, err := db.Exec("SELECT InitSpatialMetadata(1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A road crossing a railway at (1 0), and a road ending on it at (1 2).
+	createLineLayer(t, "lines", "highway", "primary", []string{
+		"LINESTRING(0 0, 1 0, 2 0)",
+		"LINESTRING(0 2, 1 2)",
+	}, db)
+	createLineLayer(t, "rails", "railway", "rail", []string{
+		"LINESTRING(1 -1, 1 0, 1 1, 1 2, 1 3)",
+	}, db)
+
+	strConfig := filepath.Join(t.TempDir(), "split.yml")
+	err := os.WriteFile(strConfig, []byte(`configs:
+  - linelayer: "lines"
+    linenodelayer: "lines_nodes"
+    nodelayer: "nodes"
+    network: "road"
+    workers: 1
+  - linelayer: "rails"
+    linenodelayer: "rails_nodes"
+    nodelayer: "nodes"
+    network: "rail"
+    workers: 1
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SplitLines(strConfig, db)
+
+	for _, tt := range []struct {
+		tblName string
+		want    int
+	}{
+		{"lines", 3},
+		{"rails", 3},
+		{"nodes", 7},
+	} {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + tt.tblName).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != tt.want {
+			t.Errorf("%s has %d rows, want %d", tt.tblName, count, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		x, y     float64
+		networks string
+		degree   int
+		nodeType string
+	}{
+		{1, 0, "road,rail", 4, "junction"},
+		{1, 2, "road,rail", 3, "junction"},
+		{0, 0, "road", 1, "dead_end"},
+		{1, 3, "rail", 1, "dead_end"},
+	} {
+		var (
+			networks string
+			degree   int
+			nodeType string
+		)
+		err := db.QueryRow("SELECT networks, degree, node_type FROM nodes WHERE ST_X(GEOMETRY) = ? AND ST_Y(GEOMETRY) = ?", tt.x, tt.y).Scan(&networks, &degree, &nodeType)
+		if err != nil {
+			t.Fatalf("node (%v %v): %v", tt.x, tt.y, err)
+		}
+		if networks != tt.networks || degree != tt.degree || nodeType != tt.nodeType {
+			t.Errorf("node (%v %v) = %s, %d, %s, want %s, %d, %s", tt.x, tt.y, networks, degree, nodeType, tt.networks, tt.degree, tt.nodeType)
+		}
+	}
+
+	// Each network links its line ends to the shared nodes.
+	for _, lineNodeLayer := range []string{"lines_nodes", "rails_nodes"} {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + lineNodeLayer + " WHERE node_fid IS NULL OR node_fid NOT IN (SELECT ogc_fid FROM nodes)").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count > 0 {
+			t.Errorf("%s has %d line ends without a node", lineNodeLayer, count)
+		}
+	}
+}
+
+// splitWithConfig runs SplitLines with the YAML config.
+func splitWithConfig(t *testing.T, strConfig string, db *sql.DB) {
+	t.Helper()
+
+	strFile := filepath.Join(t.TempDir(), "split.yml")
+	if err := os.WriteFile(strFile, []byte(strConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	SplitLines(strFile, db)
+}
+
+func queryInt(t *testing.T, strSql string, db *sql.DB, args ...interface{}) int {
+	t.Helper()
+
+	var n int
+	if err := db.QueryRow(strSql, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", strSql, err)
+	}
+	return n
+}
+
+// queryFids returns the ogc_fids as a YAML list.
+func queryFids(t *testing.T, strSql string, db *sql.DB) string {
+	t.Helper()
+
+	rows, err := db.Query(strSql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	fids := []string{}
+	for rows.Next() {
+		var fid int64
+		if err := rows.Scan(&fid); err != nil {
+			t.Fatal(err)
+		}
+		fids = append(fids, fmt.Sprint(fid))
+	}
+	return "[" + strings.Join(fids, ", ") + "]"
+}
+
+func checkCounts(t *testing.T, step string, counts map[string]int, db *sql.DB) {
+	t.Helper()
+
+	for strSql, want := range counts {
+		if got := queryInt(t, strSql, db); got != want {
+			t.Errorf("%s: %s = %d, want %d", step, strSql, got, want)
+		}
+	}
+}
+
+func TestResplitLines(t *testing.T) {
+	db := openSpatialite(t)
+	if _, err := db.Exec("SELECT InitSpatialMetadata(1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A road crossed by a second one at (1 0), and continued by a third.
+	createLineLayer(t, "lines", "highway", "primary", []string{
+		"LINESTRING(0 0, 1 0, 2 0)",
+		"LINESTRING(1 -1, 1 0, 1 1)",
+		"LINESTRING(2 0, 3 0)",
+	}, db)
+
+	strConfig := `configs:
+  - linelayer: "lines"
+    linenodelayer: "lines_nodes"
+    nodelayer: "nodes"
+    workers: 1
+`
+	splitWithConfig(t, strConfig, db)
+	checkCounts(t, "split", map[string]int{
+		"SELECT COUNT(*) FROM lines": 5,
+		"SELECT COUNT(*) FROM nodes": 6,
+	}, db)
+
+	// Deleting the crossing road joins the first road back at (1 0).
+	strDeleted := queryFids(t, "SELECT ogc_fid FROM lines WHERE orig_fid = 2", db)
+	splitWithConfig(t, strConfig+`    mode: "incremental"
+    deleted: `+strDeleted+`
+`, db)
+	checkCounts(t, "delete", map[string]int{
+		"SELECT COUNT(*) FROM lines":                                                       2,
+		"SELECT COUNT(*) FROM lines WHERE orig_fid = 1":                                    1,
+		"SELECT COUNT(*) FROM nodes":                                                       3,
+		"SELECT COUNT(*) FROM nodes WHERE ST_X(GEOMETRY) = 1":                              0,
+		"SELECT intersections FROM nodes WHERE ST_Equals(GEOMETRY, MakePoint(2, 0, 4326))": 2,
+		"SELECT COUNT(*) FROM lines_nodes WHERE node_fid IS NULL":                          0,
+	}, db)
+	var strLine string
+	if err := db.QueryRow("SELECT AsText(GEOMETRY) FROM lines WHERE orig_fid = 1").Scan(&strLine); err != nil {
+		t.Fatal(err)
+	}
+	if strLine != "LINESTRING(0 0, 1 0, 2 0)" {
+		t.Errorf("delete: joined line = %s, want LINESTRING(0 0, 1 0, 2 0)", strLine)
+	}
+
+	// Moving the third road across the first one at (1 0) splits both there.
+	if _, err := db.Exec("UPDATE lines SET GEOMETRY = GeomFromText('LINESTRING(1 -1, 1 0, 1 1)', 4326) WHERE ogc_fid = 3"); err != nil {
+		t.Fatal(err)
+	}
+	splitWithConfig(t, strConfig+`    mode: "incremental"
+    updated: [3]
+`, db)
+	checkCounts(t, "update", map[string]int{
+		"SELECT COUNT(*) FROM lines":                                                       4,
+		"SELECT COUNT(*) FROM lines WHERE orig_fid = 1":                                    2,
+		"SELECT COUNT(*) FROM lines WHERE orig_fid = 3":                                    2,
+		"SELECT COUNT(*) FROM nodes":                                                       5,
+		"SELECT COUNT(*) FROM nodes WHERE ST_X(GEOMETRY) = 3":                              0,
+		"SELECT intersections FROM nodes WHERE ST_Equals(GEOMETRY, MakePoint(1, 0, 4326))": 4,
+		"SELECT intersections FROM nodes WHERE ST_Equals(GEOMETRY, MakePoint(2, 0, 4326))": 1,
+		"SELECT COUNT(*) FROM lines_nodes WHERE node_fid IS NULL":                          0,
+	}, db)
+}
+
+func TestResplitLinesTransform(t *testing.T) {
+	db := openSpatialite(t)
+	if _, err := db.Exec("SELECT InitSpatialMetadata(1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	createLineLayer(t, "lines", "highway", "primary", []string{
+		"LINESTRING(3 0, 3.001 0, 3.002 0)",
+		"LINESTRING(3.001 -0.001, 3.001 0, 3.001 0.001)",
+		"LINESTRING(3.002 0, 3.003 0)",
+	}, db)
+
+	strConfig := `configs:
+  - linelayer: "lines"
+    linenodelayer: "lines_nodes"
+    nodelayer: "nodes"
+    transform: 32631
+    workers: 1
+`
+	splitWithConfig(t, strConfig, db)
+	checkCounts(t, "split", map[string]int{
+		"SELECT COUNT(*) FROM lines_32631": 5,
+		"SELECT COUNT(*) FROM nodes":       6,
+	}, db)
+
+	// The edits are made in the imported layer and synced into the copy.
+	strSqls := []string{
+		"DELETE FROM lines WHERE ogc_fid = 2",
+		"UPDATE lines SET GEOMETRY = GeomFromText('LINESTRING(3.001 -0.001, 3.001 0, 3.001 0.001)', 4326) WHERE ogc_fid = 3",
+	}
+	for _, strSql := range strSqls {
+		if _, err := db.Exec(strSql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	splitWithConfig(t, strConfig+`    mode: "incremental"
+    updated: [3]
+    deleted: [2]
+`, db)
+	checkCounts(t, "resplit", map[string]int{
+		"SELECT COUNT(*) FROM lines_32631":                                                                       4,
+		"SELECT COUNT(*) FROM lines_32631 WHERE orig_fid = 1":                                                    2,
+		"SELECT COUNT(*) FROM lines_32631 WHERE orig_fid = 2":                                                    0,
+		"SELECT COUNT(*) FROM lines_32631 WHERE orig_fid = 3":                                                    2,
+		"SELECT COUNT(*) FROM nodes":                                                                             5,
+		"SELECT COUNT(*) FROM lines_nodes WHERE node_fid IS NULL OR node_fid NOT IN (SELECT ogc_fid FROM nodes)": 0,
+	}, db)
+}
@@ -0,0 +1,410 @@
+package osmnode
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkb"
+	"github.com/paulmach/orb/planar"
+	OAT "navinfo.com/osmsqlitetools/internal/pkg/osmattr"
+)
+
+type polygon struct {
+	fid   int64
+	geom  orb.MultiPolygon
+	bound orb.Bound
+	attrs []sql.NullString
+}
+
+type edge struct {
+	a orb.Point
+	b orb.Point
+}
+
+// edgeIndex is a uniform grid of the polygon ring edges, each edge being
+// registered in every cell its bound overlaps.
+type edgeIndex struct {
+	size  float64
+	cells map[[2]int][]int
+	edges []edge
+}
+
+func (c LinesSplitConfig) polygonPrefix() string {
+	if len(c.PolygonPrefix) > 0 {
+		return c.PolygonPrefix
+	}
+	return "polygon"
+}
+
+// splitByPolygons cuts the lines where they cross the boundaries of the
+// polygons, then stamps each line with the polygon containing it.
+func splitByPolygons(c LinesSplitConfig, db *sql.DB) {
+	log.Println("Start split line with polygon boundaries")
+
+	polygons := loadPolygons(c, db)
+	idx := newEdgeIndex(polygons)
+
+	initLineage(c, db)
+	tmpTblName := createTmpTable(c, db)
+
+	strSql := fmt.Sprintf("SELECT ogc_fid, ST_AsBinary(GEOMETRY) FROM %s WHERE GEOMETRY IS NOT NULL", tmpTblName)
+	rows, err := db.Query(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	w := newLineWriter(c, tmpTblName, db)
+	for rows.Next() {
+		var (
+			ogcFid   int64
+			geomData []byte
+		)
+		if err := rows.Scan(&ogcFid, &geomData); err != nil {
+			log.Fatalln(err)
+		}
+
+		geom, err := wkb.Unmarshal(geomData)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		l, ok := geom.(orb.LineString)
+		if !ok {
+			continue
+		}
+
+		segs := cutAtEdges(l, idx)
+		if len(segs) < 2 {
+			continue
+		}
+
+		res := splitResult{ogcFid: ogcFid}
+		for _, seg := range segs {
+			data, err := wkb.Marshal(seg.line)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			res.geoms = append(res.geoms, data)
+			res.ranges = append(res.ranges, [2]int{seg.from, seg.to})
+		}
+		w.write(res)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+	rows.Close()
+	w.close()
+
+	updateSegIndex(c, db)
+	dropTmpTable(tmpTblName, db)
+
+	stampPolygons(c, polygons, db)
+
+	log.Printf("Finished split line with polygon boundaries, %d lines split", w.count)
+}
+
+func loadPolygons(c LinesSplitConfig, db *sql.DB) []polygon {
+	strCols := ""
+	for _, f := range c.PolygonFields {
+		strCols += fmt.Sprintf(", CAST(%s AS TEXT)", f)
+	}
+
+	strGeom := geomCol(c.PolygonLayer.Layer, "GEOMETRY", c.SRID, db)
+	strSql := fmt.Sprintf("SELECT ogc_fid, ST_AsBinary(%s)%s FROM %s WHERE GEOMETRY IS NOT NULL AND %s", strGeom, strCols, c.PolygonLayer.Layer, c.PolygonLayer.where(db))
+	rows, err := db.Query(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	polygons := []polygon{}
+	for rows.Next() {
+		var (
+			p        polygon
+			geomData []byte
+		)
+		p.attrs = make([]sql.NullString, len(c.PolygonFields))
+		dest := []any{&p.fid, &geomData}
+		for i := range p.attrs {
+			dest = append(dest, &p.attrs[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			log.Fatalln(err)
+		}
+
+		geom, err := wkb.Unmarshal(geomData)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		switch g := geom.(type) {
+		case orb.MultiPolygon:
+			p.geom = g
+		case orb.Polygon:
+			p.geom = orb.MultiPolygon{g}
+		default:
+			continue
+		}
+		p.bound = p.geom.Bound()
+		polygons = append(polygons, p)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	return polygons
+}
+
+func newEdgeIndex(polygons []polygon) *edgeIndex {
+	idx := &edgeIndex{cells: make(map[[2]int][]int)}
+
+	total := 0.0
+	for _, p := range polygons {
+		for _, poly := range p.geom {
+			for _, ring := range poly {
+				for i := 1; i < len(ring); i++ {
+					e := edge{a: ring[i-1], b: ring[i]}
+					idx.edges = append(idx.edges, e)
+					total += math.Max(math.Abs(e.b[0]-e.a[0]), math.Abs(e.b[1]-e.a[1]))
+				}
+			}
+		}
+	}
+	if len(idx.edges) == 0 {
+		return idx
+	}
+
+	// Cells a few times the average edge extent keep the edges per cell low.
+	idx.size = 4 * total / float64(len(idx.edges))
+	if idx.size == 0 {
+		idx.size = 1
+	}
+
+	for i, e := range idx.edges {
+		idx.visit(e.a, e.b, func(cell [2]int) {
+			idx.cells[cell] = append(idx.cells[cell], i)
+		})
+	}
+
+	return idx
+}
+
+func (idx *edgeIndex) visit(a orb.Point, b orb.Point, fn func(cell [2]int)) {
+	x0, x1 := int(math.Floor(math.Min(a[0], b[0])/idx.size)), int(math.Floor(math.Max(a[0], b[0])/idx.size))
+	y0, y1 := int(math.Floor(math.Min(a[1], b[1])/idx.size)), int(math.Floor(math.Max(a[1], b[1])/idx.size))
+	for x := x0; x <= x1; x++ {
+		for y := y0; y <= y1; y++ {
+			fn([2]int{x, y})
+		}
+	}
+}
+
+// crossings returns the positions, as a fraction of the segment, where the
+// segment crosses an edge.
+func (idx *edgeIndex) crossings(a orb.Point, b orb.Point) []float64 {
+	if len(idx.edges) == 0 {
+		return nil
+	}
+
+	seen := map[int]bool{}
+	ts := []float64{}
+	idx.visit(a, b, func(cell [2]int) {
+		for _, i := range idx.cells[cell] {
+			if seen[i] {
+				continue
+			}
+			seen[i] = true
+			if t, ok := intersect(a, b, idx.edges[i].a, idx.edges[i].b); ok {
+				ts = append(ts, t)
+			}
+		}
+	})
+	sort.Float64s(ts)
+
+	return ts
+}
+
+// intersect returns the position along p1-p2 where it crosses q1-q2. Parallel
+// segments are not reported.
+func intersect(p1 orb.Point, p2 orb.Point, q1 orb.Point, q2 orb.Point) (float64, bool) {
+	r := orb.Point{p2[0] - p1[0], p2[1] - p1[1]}
+	s := orb.Point{q2[0] - q1[0], q2[1] - q1[1]}
+	denom := r[0]*s[1] - r[1]*s[0]
+	if denom == 0 {
+		return 0, false
+	}
+
+	qp := orb.Point{q1[0] - p1[0], q1[1] - p1[1]}
+	t := (qp[0]*s[1] - qp[1]*s[0]) / denom
+	u := (qp[0]*r[1] - qp[1]*r[0]) / denom
+	if t < 0 || t > 1 || u < 0 || u > 1 {
+		return 0, false
+	}
+
+	return t, true
+}
+
+// cutAtEdges inserts a vertex where the line crosses a polygon edge and cuts
+// the line there. The vertex ranges of the segments refer to the original
+// vertices, an inserted vertex counting as the one before it for from and the
+// one after it for to.
+func cutAtEdges(l orb.LineString, idx *edgeIndex) []segment {
+	const eps = 1e-9
+
+	var (
+		line    orb.LineString
+		floors  []int
+		ceils   []int
+		cutIdxs []int
+		cutNext bool
+	)
+	for i := 0; i < len(l)-1; i++ {
+		line = append(line, l[i])
+		floors = append(floors, i)
+		ceils = append(ceils, i)
+		if cutNext {
+			cutIdxs = append(cutIdxs, len(line)-1)
+			cutNext = false
+		}
+
+		last := -1.0
+		for _, t := range idx.crossings(l[i], l[i+1]) {
+			switch {
+			case t < eps:
+				cutIdxs = append(cutIdxs, len(line)-1)
+			case t > 1-eps:
+				cutNext = true
+			case t-last > eps:
+				line = append(line, orb.Point{l[i][0] + t*(l[i+1][0]-l[i][0]), l[i][1] + t*(l[i+1][1]-l[i][1])})
+				floors = append(floors, i)
+				ceils = append(ceils, i+1)
+				cutIdxs = append(cutIdxs, len(line)-1)
+				last = t
+			}
+		}
+	}
+	line = append(line, l[len(l)-1])
+	floors = append(floors, len(l)-1)
+	ceils = append(ceils, len(l)-1)
+
+	segs := cutLineString(line, cutIdxs)
+	for i := range segs {
+		segs[i].from = floors[segs[i].from]
+		segs[i].to = ceils[segs[i].to]
+	}
+
+	return segs
+}
+
+// stampPolygons writes the ogc_fid and the fields of the polygon containing
+// each line into the <prefix>_fid and <prefix>_<field> columns.
+func stampPolygons(c LinesSplitConfig, polygons []polygon, db *sql.DB) {
+	prefix := c.polygonPrefix()
+	cols := []string{fmt.Sprintf("%s_fid", prefix)}
+	for _, f := range c.PolygonFields {
+		cols = append(cols, fmt.Sprintf("%s_%s", prefix, f))
+	}
+	for i, col := range cols {
+		strSql := ""
+		if OAT.IsColExist(c.LineLayer, col, db) {
+			strSql = fmt.Sprintf("UPDATE %s SET %s = NULL", c.LineLayer, col)
+		} else if i == 0 {
+			strSql = fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s INTEGER", c.LineLayer, col)
+		} else {
+			strSql = fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s VARCHAR", c.LineLayer, col)
+		}
+		_, err := db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	strSql := fmt.Sprintf("SELECT ogc_fid, ST_AsBinary(GEOMETRY) FROM %s WHERE GEOMETRY IS NOT NULL", c.LineLayer)
+	rows, err := db.Query(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	stamps := map[int64]int{}
+	for rows.Next() {
+		var (
+			ogcFid   int64
+			geomData []byte
+		)
+		if err := rows.Scan(&ogcFid, &geomData); err != nil {
+			log.Fatalln(err)
+		}
+
+		geom, err := wkb.Unmarshal(geomData)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		l, ok := geom.(orb.LineString)
+		if !ok {
+			continue
+		}
+		if j := containingPolygon(l, polygons); j >= 0 {
+			stamps[ogcFid] = j
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	strSet := ""
+	for i, col := range cols {
+		if i > 0 {
+			strSet += ", "
+		}
+		strSet += fmt.Sprintf("%s = ?", col)
+	}
+	strSql = fmt.Sprintf("UPDATE %s SET %s WHERE ogc_fid = ?", c.LineLayer, strSet)
+	stmt, err := tx.Prepare(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer stmt.Close()
+
+	for ogcFid, j := range stamps {
+		args := []any{polygons[j].fid}
+		for _, a := range polygons[j].attrs {
+			args = append(args, a)
+		}
+		args = append(args, ogcFid)
+		_, err := stmt.Exec(args...)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// containingPolygon returns the index of the first polygon containing the
+// line, -1 when none does. The line lies on one side of every boundary once
+// split, so the middle of its middle edge tells which polygon contains it.
+func containingPolygon(l orb.LineString, polygons []polygon) int {
+	if len(l) < 2 {
+		return -1
+	}
+
+	i := (len(l) - 1) / 2
+	p := orb.Point{(l[i][0] + l[i+1][0]) / 2, (l[i][1] + l[i+1][1]) / 2}
+	for j, poly := range polygons {
+		if poly.bound.Contains(p) && planar.MultiPolygonContains(poly.geom, p) {
+			return j
+		}
+	}
+	return -1
+}
@@ -0,0 +1,169 @@
+package osmnode
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/paulmach/orb"
+)
+
+func newTestPolygon(fid int64, geom orb.MultiPolygon) polygon {
+	return polygon{fid: fid, geom: geom, bound: geom.Bound()}
+}
+
+func TestIntersect(t *testing.T) {
+	p1, p2 := orb.Point{0, 0}, orb.Point{2, 0}
+	tests := []struct {
+		name   string
+		q1, q2 orb.Point
+		want   float64
+		ok     bool
+	}{
+		{"crossing", orb.Point{1, -1}, orb.Point{1, 1}, 0.5, true},
+		{"disjoint", orb.Point{3, -1}, orb.Point{3, 1}, 0, false},
+		{"on the segment end", orb.Point{2, -1}, orb.Point{2, 1}, 1, true},
+		{"edge vertex on the segment", orb.Point{1, 0}, orb.Point{1, 1}, 0.5, true},
+		{"parallel", orb.Point{0, 1}, orb.Point{2, 1}, 0, false},
+		{"collinear overlap", orb.Point{1, 0}, orb.Point{3, 0}, 0, false},
+		{"collinear touching", orb.Point{2, 0}, orb.Point{3, 0}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := intersect(p1, p2, tt.q1, tt.q2)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("intersect() = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestEdgeIndexCrossings(t *testing.T) {
+	// The edges are 8 long, so the cells are 32 wide and the right edge lies
+	// on the boundary between the cells 0 and 1.
+	idx := newEdgeIndex([]polygon{newTestPolygon(1, orb.MultiPolygon{{{{24, 0}, {32, 0}, {32, 8}, {24, 8}, {24, 0}}}})})
+	if idx.size != 32 {
+		t.Fatalf("newEdgeIndex() cell size = %v, want 32", idx.size)
+	}
+
+	tests := []struct {
+		name string
+		a, b orb.Point
+		want []float64
+	}{
+		{"edge on a cell boundary", orb.Point{28, 4}, orb.Point{36, 4}, []float64{0.5}},
+		{"ending on an edge on a cell boundary", orb.Point{16, 4}, orb.Point{32, 4}, []float64{0.5, 1}},
+		{"edge on a row boundary", orb.Point{28, -4}, orb.Point{28, 4}, []float64{0.5}},
+		{"through a polygon vertex", orb.Point{20, -4}, orb.Point{28, 4}, []float64{0.5, 0.5}},
+		{"no edge", orb.Point{0, 0}, orb.Point{8, 0}, []float64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := idx.crossings(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("crossings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := newEdgeIndex(nil).crossings(orb.Point{0, 0}, orb.Point{1, 1}); got != nil {
+		t.Errorf("crossings() without polygons = %v, want nil", got)
+	}
+}
+
+func TestCutAtEdges(t *testing.T) {
+	idx := newEdgeIndex([]polygon{newTestPolygon(1, orb.MultiPolygon{{{{0, 0}, {2, 0}, {2, 2}, {0, 2}, {0, 0}}}})})
+
+	tests := []struct {
+		name string
+		line orb.LineString
+		want []segment
+	}{
+		{
+			name: "no crossing",
+			line: orb.LineString{{0.5, 0.5}, {1, 1}},
+			want: []segment{{line: orb.LineString{{0.5, 0.5}, {1, 1}}, from: 0, to: 1}},
+		},
+		{
+			name: "crossing between vertices",
+			line: orb.LineString{{-1, 1}, {1, 1}},
+			want: []segment{
+				{line: orb.LineString{{-1, 1}, {0, 1}}, from: 0, to: 1},
+				{line: orb.LineString{{0, 1}, {1, 1}}, from: 0, to: 1},
+			},
+		},
+		{
+			name: "crossing twice in one segment",
+			line: orb.LineString{{-1, 1}, {3, 1}},
+			want: []segment{
+				{line: orb.LineString{{-1, 1}, {0, 1}}, from: 0, to: 1},
+				{line: orb.LineString{{0, 1}, {2, 1}}, from: 0, to: 1},
+				{line: orb.LineString{{2, 1}, {3, 1}}, from: 0, to: 1},
+			},
+		},
+		{
+			name: "crossing on a line vertex",
+			line: orb.LineString{{-1, 1}, {0, 1}, {1, 1}},
+			want: []segment{
+				{line: orb.LineString{{-1, 1}, {0, 1}}, from: 0, to: 1},
+				{line: orb.LineString{{0, 1}, {1, 1}}, from: 1, to: 2},
+			},
+		},
+		{
+			name: "through a polygon vertex",
+			line: orb.LineString{{-1, -1}, {1, 1}},
+			want: []segment{
+				{line: orb.LineString{{-1, -1}, {0, 0}}, from: 0, to: 1},
+				{line: orb.LineString{{0, 0}, {1, 1}}, from: 0, to: 1},
+			},
+		},
+		{
+			name: "collinear overlap",
+			line: orb.LineString{{-1, 0}, {3, 0}},
+			want: []segment{
+				{line: orb.LineString{{-1, 0}, {0, 0}}, from: 0, to: 1},
+				{line: orb.LineString{{0, 0}, {2, 0}}, from: 0, to: 1},
+				{line: orb.LineString{{2, 0}, {3, 0}}, from: 0, to: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cutAtEdges(tt.line, idx); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cutAtEdges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainingPolygon(t *testing.T) {
+	polygons := []polygon{
+		newTestPolygon(1, orb.MultiPolygon{{
+			{{0, 0}, {2, 0}, {2, 2}, {0, 2}, {0, 0}},
+			{{0.5, 0.5}, {1.5, 0.5}, {1.5, 1.5}, {0.5, 1.5}, {0.5, 0.5}},
+		}}),
+		newTestPolygon(2, orb.MultiPolygon{{{{1, 0}, {3, 0}, {3, 2}, {1, 2}, {1, 0}}}}),
+	}
+
+	tests := []struct {
+		name string
+		line orb.LineString
+		want int
+	}{
+		{"inside", orb.LineString{{0.1, 0.1}, {0.3, 0.1}}, 0},
+		{"middle edge", orb.LineString{{0.1, 0.1}, {0.2, 0.1}, {0.3, 0.1}}, 0},
+		{"in a hole", orb.LineString{{1.1, 1}, {1.3, 1}}, 1},
+		{"in two polygons", orb.LineString{{1.8, 0.2}, {1.9, 0.2}}, 0},
+		{"outside", orb.LineString{{5, 5}, {6, 5}}, -1},
+		{"single vertex", orb.LineString{{0.1, 0.1}}, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := containingPolygon(tt.line, polygons); got != tt.want {
+				t.Errorf("containingPolygon() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
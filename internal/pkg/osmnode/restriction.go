@@ -0,0 +1,415 @@
+package osmnode
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkb"
+	"gopkg.in/yaml.v3"
+	OAT "navinfo.com/osmsqlitetools/internal/pkg/osmattr"
+	OGM "navinfo.com/osmsqlitetools/internal/pkg/osmgeom"
+)
+
+type RestrictionConfigs struct {
+	Configs []RestrictionConfig
+}
+
+type RestrictionConfig struct {
+	RelationLayer    string
+	LineLayer        string
+	LineNodeLayer    string
+	NodeLayer        string
+	RestrictionLayer string
+}
+
+type restriction struct {
+	osmID  int64
+	kind   string
+	except string
+	froms  []orb.LineString
+	via    orb.Point
+	tos    []orb.LineString
+}
+
+// member is a node or way member of a relation with its role.
+type member struct {
+	kind string
+	role string
+}
+
+func loadRestrictionConfigs(filename string) RestrictionConfigs {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var conf RestrictionConfigs
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return conf
+}
+
+// ExtractRestrictions resolves the restriction relations against the split
+// lines and the nodes, the from and to ways of a relation being matched to the
+// lines which leave the via node along them.
+func ExtractRestrictions(strConfigFileName string, db *sql.DB) {
+	conf := loadRestrictionConfigs(strConfigFileName)
+	for _, c := range conf.Configs {
+		log.Println("Start extract turn restrictions")
+
+		createRestrictionTable(c, db)
+
+		srid := OGM.LayerSRID(c.NodeLayer, db)
+		restrictions := loadRestrictions(c, srid, db)
+		nodes := loadNodes(c.NodeLayer, db)
+
+		strSql := fmt.Sprintf("SELECT l.ogc_fid, ST_AsBinary(l.GEOMETRY) FROM %s AS ln JOIN %s AS l ON l.ogc_fid = ln.lines_fid WHERE ln.node_fid = ?", c.LineNodeLayer, c.LineLayer)
+		stmtLines, err := db.Prepare(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer stmtLines.Close()
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		strSql = fmt.Sprintf(`INSERT INTO %s (osm_id, from_line_fid, via_node_fid, to_line_fid, type, "except") VALUES (?, ?, ?, ?, ?, ?)`, c.RestrictionLayer)
+		stmtIns, err := tx.Prepare(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer stmtIns.Close()
+
+		resolved := 0
+		for _, r := range restrictions {
+			nodeFid, ok := nodes[r.via]
+			if !ok {
+				continue
+			}
+
+			lines := loadViaLines(nodeFid, stmtLines)
+			pairs := [][2]int64{}
+			for _, from := range r.froms {
+				for _, to := range r.tos {
+					froms, tos := matchRestrictionLines(lines, r.via, from), matchRestrictionLines(lines, r.via, to)
+					if len(froms) == 1 && len(tos) == 1 {
+						pairs = append(pairs, [2]int64{froms[0], tos[0]})
+					} else if from.Equal(to) {
+						// A u-turn on the same way, each side of the via node is its own restriction.
+						for _, fid := range froms {
+							pairs = append(pairs, [2]int64{fid, fid})
+						}
+					}
+				}
+			}
+
+			for _, p := range pairs {
+				_, err := stmtIns.Exec(r.osmID, p[0], nodeFid, p[1], r.kind, r.except)
+				if err != nil {
+					log.Fatalln(err)
+				}
+			}
+			if len(pairs) > 0 {
+				resolved++
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		log.Printf("Finished extract turn restrictions, %d of %d resolved", resolved, len(restrictions))
+	}
+}
+
+func createRestrictionTable(c RestrictionConfig, db *sql.DB) {
+	strSql := fmt.Sprintf("DROP TABLE IF EXISTS %s", c.RestrictionLayer)
+	_, err := db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	strSql = fmt.Sprintf(`CREATE TABLE %s (ogc_fid INTEGER PRIMARY KEY AUTOINCREMENT, osm_id BIGINT, from_line_fid INTEGER, via_node_fid INTEGER, to_line_fid INTEGER, type VARCHAR, "except" VARCHAR)`, c.RestrictionLayer)
+	_, err = db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// loadRestrictions reads the via node restrictions. The members of the relation
+// are kept as a geometry collection in member order, their from, via and to
+// roles being taken from relation_members. Without relation_members the first
+// way is taken as from and the last one as to.
+func loadRestrictions(c RestrictionConfig, srid int, db *sql.DB) []restriction {
+	roles := loadRestrictionRoles(db)
+
+	strSql := fmt.Sprintf("SELECT osm_id, other_tags, ST_AsBinary(%s) FROM %s WHERE type = 'restriction' AND GEOMETRY IS NOT NULL", geomCol(c.RelationLayer, "GEOMETRY", srid, db), c.RelationLayer)
+	rows, err := db.Query(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	restrictions := []restriction{}
+	viaWays, missing := 0, 0
+	for rows.Next() {
+		var (
+			osmID    int64
+			tags     sql.NullString
+			geomData []byte
+		)
+		if err := rows.Scan(&osmID, &tags, &geomData); err != nil {
+			log.Fatalln(err)
+		}
+
+		geom, err := wkb.Unmarshal(geomData)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		col, ok := geom.(orb.Collection)
+		if !ok {
+			continue
+		}
+
+		m := OAT.ParseTags(tags.String)
+		r := restriction{osmID: osmID, kind: restrictionKind(m), except: m["except"]}
+		var (
+			vias   []orb.Point
+			viaWay bool
+		)
+		if roles != nil {
+			members := roles[osmID]
+			if len(members) != len(col) {
+				// A member is missing from the file, the roles cannot be matched.
+				missing++
+				continue
+			}
+			for i, g := range col {
+				switch g := g.(type) {
+				case orb.LineString:
+					switch members[i].role {
+					case "from":
+						r.froms = append(r.froms, g)
+					case "to":
+						r.tos = append(r.tos, g)
+					case "via":
+						viaWay = true
+					}
+				case orb.Point:
+					if members[i].role == "via" {
+						vias = append(vias, g)
+					}
+				}
+			}
+		} else {
+			var ways []orb.LineString
+			for _, g := range col {
+				switch g := g.(type) {
+				case orb.LineString:
+					ways = append(ways, g)
+				case orb.Point:
+					vias = append(vias, g)
+				}
+			}
+			if len(ways) >= 2 {
+				r.froms, r.tos = ways[:1], ways[len(ways)-1:]
+			}
+			viaWay = len(ways) > 2
+		}
+		if viaWay {
+			viaWays++
+			continue
+		}
+		if len(vias) != 1 || len(r.froms) == 0 || len(r.tos) == 0 {
+			continue
+		}
+		r.via = vias[0]
+		restrictions = append(restrictions, r)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if viaWays > 0 {
+		log.Printf("%d restrictions with via ways are skipped", viaWays)
+	}
+	if missing > 0 {
+		log.Printf("%d restrictions with members missing from the file are skipped", missing)
+	}
+
+	return restrictions
+}
+
+// loadRestrictionRoles returns the node and way members of the restriction
+// relations in order, nil when relation_members was not imported.
+func loadRestrictionRoles(db *sql.DB) map[int64][]member {
+	if !OAT.IsTblExist(memberLayer, db) || !OAT.IsTblExist("relations", db) {
+		return nil
+	}
+
+	strSql := fmt.Sprintf("SELECT m.relation_id, m.member_type, m.role FROM %s AS m JOIN relations AS r ON r.relation_id = m.relation_id WHERE r.type = 'restriction' AND m.member_type IN ('node', 'way') ORDER BY m.relation_id, m.seq", memberLayer)
+	rows, err := db.Query(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	roles := map[int64][]member{}
+	for rows.Next() {
+		var (
+			id   int64
+			m    member
+			role sql.NullString
+		)
+		if err := rows.Scan(&id, &m.kind, &role); err != nil {
+			log.Fatalln(err)
+		}
+		m.role = role.String
+		roles[id] = append(roles[id], m)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	return roles
+}
+
+// restrictionKind returns the restriction tag, else the one of
+// restriction:motorcar, else the first restriction:* tag by key.
+func restrictionKind(tags map[string]string) string {
+	if v, ok := tags["restriction"]; ok {
+		return v
+	}
+	if v, ok := tags["restriction:motorcar"]; ok {
+		return v
+	}
+
+	keys := []string{}
+	for k := range tags {
+		if strings.HasPrefix(k, "restriction:") {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+	return tags[keys[0]]
+}
+
+func loadNodes(nodeLayer string, db *sql.DB) map[orb.Point]int64 {
+	strSql := fmt.Sprintf("SELECT ogc_fid, ST_X(GEOMETRY), ST_Y(GEOMETRY) FROM %s", nodeLayer)
+	rows, err := db.Query(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	nodes := make(map[orb.Point]int64)
+	for rows.Next() {
+		var (
+			fid int64
+			p   orb.Point
+		)
+		if err := rows.Scan(&fid, &p[0], &p[1]); err != nil {
+			log.Fatalln(err)
+		}
+		nodes[p] = fid
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	return nodes
+}
+
+type viaLine struct {
+	fid  int64
+	line orb.LineString
+}
+
+// loadViaLines returns the lines at the via node.
+func loadViaLines(nodeFid int64, stmt *sql.Stmt) []viaLine {
+	rows, err := stmt.Query(nodeFid)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	lines := []viaLine{}
+	for rows.Next() {
+		var (
+			fid      int64
+			geomData []byte
+		)
+		if err := rows.Scan(&fid, &geomData); err != nil {
+			log.Fatalln(err)
+		}
+
+		geom, err := wkb.Unmarshal(geomData)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if l, ok := geom.(orb.LineString); ok && len(l) >= 2 {
+			lines = append(lines, viaLine{fid, l})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	return lines
+}
+
+// matchRestrictionLines returns the lines at the via node which continue along
+// the way, by checking the vertex next to the via node.
+func matchRestrictionLines(lines []viaLine, via orb.Point, way orb.LineString) []int64 {
+	fids := []int64{}
+	for _, l := range lines {
+		for _, next := range adjacentVertices(l.line, via) {
+			if isSegmentOf(way, via, next) && !containsFid(fids, l.fid) {
+				fids = append(fids, l.fid)
+			}
+		}
+	}
+	return fids
+}
+
+func adjacentVertices(l orb.LineString, p orb.Point) []orb.Point {
+	pnts := []orb.Point{}
+	if l[0] == p {
+		pnts = append(pnts, l[1])
+	}
+	if l[len(l)-1] == p {
+		pnts = append(pnts, l[len(l)-2])
+	}
+	return pnts
+}
+
+func isSegmentOf(l orb.LineString, a orb.Point, b orb.Point) bool {
+	for i := 1; i < len(l); i++ {
+		if (l[i-1] == a && l[i] == b) || (l[i-1] == b && l[i] == a) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFid(fids []int64, fid int64) bool {
+	for _, f := range fids {
+		if f == fid {
+			return true
+		}
+	}
+	return false
+}
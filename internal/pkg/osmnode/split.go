@@ -0,0 +1,334 @@
+package osmnode
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkb"
+	OAT "navinfo.com/osmsqlitetools/internal/pkg/osmattr"
+)
+
+const splitBatchSize = 10000
+
+// lineWriter writes the split lines with prepared statements, committing every
+// splitBatchSize lines. The first piece keeps the ogc_fid of the line and the
+// others are inserted with the attributes copied from tblName.
+type lineWriter struct {
+	db      *sql.DB
+	tx      *sql.Tx
+	stmtUpd *sql.Stmt
+	stmtIns *sql.Stmt
+	strUpd  string
+	strIns  string
+	count   int
+}
+
+func newLineWriter(c LinesSplitConfig, tblName string, db *sql.DB) *lineWriter {
+	strCols := getColsSql(tblName, db, "from_vertex", "to_vertex")
+
+	w := &lineWriter{
+		db:     db,
+		strUpd: fmt.Sprintf("UPDATE %s SET GEOMETRY = GeomFromWKB(?, %d), from_vertex = from_vertex + ?, to_vertex = from_vertex + ? WHERE ogc_fid = ?", c.LineLayer, c.SRID),
+		strIns: fmt.Sprintf("INSERT INTO %s (%s, from_vertex, to_vertex, GEOMETRY) SELECT %s, from_vertex + ?, from_vertex + ?, GeomFromWKB(?, %d) AS GEOMETRY FROM %s WHERE ogc_fid = ?", c.LineLayer, strCols, strCols, c.SRID, tblName),
+	}
+	w.begin()
+
+	return w
+}
+
+func (w *lineWriter) begin() {
+	tx, err := w.db.Begin()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	w.tx = tx
+
+	w.stmtUpd, err = tx.Prepare(w.strUpd)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	w.stmtIns, err = tx.Prepare(w.strIns)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func (w *lineWriter) commit() {
+	w.stmtUpd.Close()
+	w.stmtIns.Close()
+
+	err := w.tx.Commit()
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func (w *lineWriter) write(r splitResult) {
+	if len(r.geoms) < 2 {
+		return
+	}
+
+	for i, geomData := range r.geoms {
+		err := error(nil)
+		if i == 0 {
+			_, err = w.stmtUpd.Exec(geomData, r.ranges[i][0], r.ranges[i][1], r.ogcFid)
+		} else {
+			_, err = w.stmtIns.Exec(r.ranges[i][0], r.ranges[i][1], geomData, r.ogcFid)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	w.count++
+	if w.count%splitBatchSize == 0 {
+		w.commit()
+		w.begin()
+	}
+}
+
+func (w *lineWriter) close() {
+	w.commit()
+}
+
+type splitResult struct {
+	ogcFid int64
+	geoms  [][]byte
+	// ranges are the first and last vertex index of each piece in the line.
+	ranges [][2]int
+}
+
+type fidRange struct {
+	lo int64
+	hi int64
+}
+
+// splitLines cuts the lines at the vertices shared with other lines. The lines
+// are partitioned into ogc_fid ranges, each range being read in one query from
+// the copy of the layer in tblName and cut by one of the workers, while a
+// single writer stores the results.
+func splitLines(c LinesSplitConfig, tblName string, db *sql.DB) {
+	log.Println("Start split line with intersection nodes")
+
+	workers := c.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	// The writer needs a connection of its own.
+	if maxConns := db.Stats().MaxOpenConnections; maxConns > 0 && workers >= maxConns {
+		workers = maxConns - 1
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	ranges := make(chan fidRange)
+	results := make(chan splitResult, splitBatchSize)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range ranges {
+				splitRange(c, tblName, r, db, results)
+			}
+		}()
+	}
+
+	done := make(chan int)
+	go func() {
+		w := newLineWriter(c, tblName, db)
+		for r := range results {
+			w.write(r)
+		}
+		w.close()
+		done <- w.count
+	}()
+
+	for _, r := range splitRanges(c, workers, db) {
+		ranges <- r
+	}
+	close(ranges)
+	wg.Wait()
+	close(results)
+
+	log.Printf("Finished split line with intersection nodes, %d lines split by %d workers", <-done, workers)
+}
+
+// splitRanges divides the ogc_fid of the lines to split into several ranges
+// per worker, so a slow range does not hold back the others.
+func splitRanges(c LinesSplitConfig, workers int, db *sql.DB) []fidRange {
+	var minFid, maxFid sql.NullInt64
+	strSql := fmt.Sprintf("SELECT MIN(lines_fid), MAX(lines_fid) FROM %s WHERE intersections > 1 AND pos_type = 0", c.LineNodeLayer)
+	err := db.QueryRow(strSql).Scan(&minFid, &maxFid)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if !minFid.Valid {
+		return nil
+	}
+
+	count := int64(workers * 4)
+	step := (maxFid.Int64-minFid.Int64)/count + 1
+
+	ranges := []fidRange{}
+	for lo := minFid.Int64; lo <= maxFid.Int64; lo += step {
+		ranges = append(ranges, fidRange{lo: lo, hi: lo + step})
+	}
+	return ranges
+}
+
+func splitRange(c LinesSplitConfig, tblName string, r fidRange, db *sql.DB, results chan<- splitResult) {
+	strSql := fmt.Sprintf(`SELECT t.ogc_fid, ST_AsBinary(t.GEOMETRY), group_concat(ln.order_id)
+		FROM %s AS ln JOIN %s AS t ON t.ogc_fid = ln.lines_fid
+		WHERE ln.intersections > 1 AND ln.pos_type = 0 AND ln.lines_fid >= ? AND ln.lines_fid < ?
+		GROUP BY ln.lines_fid`, c.LineNodeLayer, tblName)
+	rows, err := db.Query(strSql, r.lo, r.hi)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			ogcFid   int64
+			geomData []byte
+			strIDs   string
+		)
+		if err := rows.Scan(&ogcFid, &geomData, &strIDs); err != nil {
+			log.Fatalln(err)
+		}
+
+		geom, err := wkb.Unmarshal(geomData)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		l, ok := geom.(orb.LineString)
+		if !ok {
+			log.Printf("Geometry of line %d is not a LineString, skipped", ogcFid)
+			continue
+		}
+
+		segs := cutLineString(l, parseOrderIDs(strIDs))
+		if len(segs) < 2 {
+			continue
+		}
+
+		res := splitResult{ogcFid: ogcFid}
+		for _, seg := range segs {
+			data, err := wkb.Marshal(seg.line)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			res.geoms = append(res.geoms, data)
+			res.ranges = append(res.ranges, [2]int{seg.from, seg.to})
+		}
+		results <- res
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// parseOrderIDs converts the 1 based order_id list to vertex indexes.
+func parseOrderIDs(strIDs string) []int {
+	idxs := []int{}
+	for _, s := range strings.Split(strIDs, ",") {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		idxs = append(idxs, id-1)
+	}
+	return idxs
+}
+
+type segment struct {
+	line orb.LineString
+	from int
+	to   int
+}
+
+// cutLineString cuts the line at the given vertex indexes. The indexes refer to
+// the vertex sequence, so closed rings and repeated vertices are cut at the
+// exact occurrence. Pieces collapsed to a single location, from repeated
+// consecutive vertices, are dropped.
+func cutLineString(l orb.LineString, idxs []int) []segment {
+	sort.Ints(idxs)
+
+	segs := []segment{}
+	start := 0
+	for i, idx := range idxs {
+		if idx <= start || idx >= len(l)-1 || (i > 0 && idx == idxs[i-1]) {
+			continue
+		}
+		if piece := l[start : idx+1]; !isCollapsed(piece) {
+			segs = append(segs, segment{line: piece, from: start, to: idx})
+		}
+		start = idx
+	}
+	if piece := l[start:]; !isCollapsed(piece) || len(segs) == 0 {
+		segs = append(segs, segment{line: piece, from: start, to: len(l) - 1})
+	}
+
+	return segs
+}
+
+func isCollapsed(l orb.LineString) bool {
+	for _, p := range l[1:] {
+		if p != l[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// initLineage adds the columns linking each segment to the original way: the
+// ogc_fid of the way, the position of the segment along it and the first and
+// last vertex of the segment in the way. Lines split in an earlier run keep
+// their lineage.
+func initLineage(c LinesSplitConfig, db *sql.DB) {
+	for _, col := range []string{"orig_fid", "seg_index", "from_vertex", "to_vertex"} {
+		if OAT.IsColExist(c.LineLayer, col, db) {
+			continue
+		}
+		strSql := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s INTEGER", c.LineLayer, col)
+		_, err := db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	strSql := fmt.Sprintf("UPDATE %s SET orig_fid = ogc_fid, seg_index = 0, from_vertex = 0, to_vertex = ST_NumPoints(GEOMETRY) - 1 WHERE orig_fid IS NULL", c.LineLayer)
+	_, err := db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	strSql = fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_orig_fid ON %s (orig_fid, from_vertex)", c.LineLayer, c.LineLayer)
+	_, err = db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// updateSegIndex numbers the segments of each way along it. Segments starting
+// between the same two vertices, cut at a polygon boundary, are ordered by
+// ogc_fid as they are inserted along the line.
+func updateSegIndex(c LinesSplitConfig, db *sql.DB) {
+	strSql := fmt.Sprintf(`UPDATE %s SET seg_index = (SELECT COUNT(*) FROM %s AS l2 WHERE l2.orig_fid = %s.orig_fid
+		AND (l2.from_vertex < %s.from_vertex OR (l2.from_vertex = %s.from_vertex AND l2.ogc_fid < %s.ogc_fid)))`,
+		c.LineLayer, c.LineLayer, c.LineLayer, c.LineLayer, c.LineLayer, c.LineLayer)
+	_, err := db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
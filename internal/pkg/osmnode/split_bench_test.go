@@ -0,0 +1,194 @@
+package osmnode
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkb"
+	"github.com/paulmach/orb/encoding/wkt"
+)
+
+const (
+	benchGridSize  = 40
+	benchCellVerts = 4
+)
+
+// gridNetwork generates benchGridSize horizontal and vertical lines as WKB,
+// crossing at every grid point, with benchCellVerts vertices per cell.
+func gridNetwork(tb testing.TB) [][]byte {
+	lines := [][]byte{}
+	for vertical := 0; vertical < 2; vertical++ {
+		for i := 0; i < benchGridSize; i++ {
+			l := orb.LineString{}
+			for j := 0; j < (benchGridSize-1)*benchCellVerts+1; j++ {
+				p := orb.Point{float64(j) / benchCellVerts * 0.001, float64(i) * 0.001}
+				if vertical == 1 {
+					p[0], p[1] = p[1], p[0]
+				}
+				l = append(l, p)
+			}
+
+			data, err := wkb.Marshal(l)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			lines = append(lines, data)
+		}
+	}
+	return lines
+}
+
+// BenchmarkSplitLines compares splitLines, the bulk read of the lines cut in Go
+// and written by the batched lineWriter, against the former path, which cut
+// each line in spatialite with ST_DissolvePoints and ST_LinesCutAtNodes and
+// wrote the pieces as WKT. Both split the same grid network, the line nodes
+// and the copy of the layer being created untimed before each run.
+func BenchmarkSplitLines(b *testing.B) {
+	db := openSpatialite(b)
+	strSqls := []string{
+		"SELECT InitSpatialMetadata(1)",
+		"CREATE TABLE grid (ogc_fid INTEGER PRIMARY KEY, osm_id VARCHAR, highway VARCHAR, GEOMETRY BLOB)",
+	}
+	for _, strSql := range strSqls {
+		if _, err := db.Exec(strSql); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for i, data := range gridNetwork(b) {
+		if _, err := db.Exec("INSERT INTO grid VALUES (?, ?, 'primary', GeomFromWKB(?, 4326))", i+1, i+1, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	c := LinesSplitConfig{LineLayer: "lines", LineNodeLayer: "lines_nodes", NodeLayer: "nodes", SRID: 4326}
+	for _, bm := range []struct {
+		name  string
+		split func(c LinesSplitConfig, tblName string, db *sql.DB)
+	}{
+		{"go", splitLines},
+		{"spatialite", legacySplitLines},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				resetBenchLayer(b, c, db)
+				createLineNode(c, db, false)
+				initLineage(c, db)
+				tmpTblName := createTmpTable(c, db)
+				b.StartTimer()
+
+				bm.split(c, tmpTblName, db)
+
+				b.StopTimer()
+				dropTmpTable(tmpTblName, db)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// resetBenchLayer recreates the line layer from the grid table.
+func resetBenchLayer(b *testing.B, c LinesSplitConfig, db *sql.DB) {
+	b.Helper()
+
+	strSqls := []string{
+		fmt.Sprintf("SELECT DropGeoTable('%s')", c.LineLayer),
+		fmt.Sprintf("CREATE TABLE %s (ogc_fid INTEGER PRIMARY KEY AUTOINCREMENT, osm_id VARCHAR, highway VARCHAR)", c.LineLayer),
+		fmt.Sprintf("SELECT AddGeometryColumn('%s', 'GEOMETRY', %d, 'LINESTRING', 'XY')", c.LineLayer, c.SRID),
+		fmt.Sprintf("INSERT INTO %s (ogc_fid, osm_id, highway, GEOMETRY) SELECT ogc_fid, osm_id, highway, GEOMETRY FROM grid", c.LineLayer),
+	}
+	for _, strSql := range strSqls {
+		if _, err := db.Exec(strSql); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// legacySplitLines is the former split: one query per line for its vertices
+// and one for its pieces, which are written as WKT in a single transaction.
+func legacySplitLines(c LinesSplitConfig, tblName string, db *sql.DB) {
+	strSql := fmt.Sprintf("SELECT lines_fid, group_concat(order_id) FROM (SELECT lines_fid, order_id FROM %s WHERE intersections > 1 AND pos_type = 0 ORDER BY lines_fid, order_id) GROUP BY lines_fid", c.LineNodeLayer)
+	rows, err := db.Query(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	type lineIdxs struct {
+		fid  int64
+		idxs []int
+	}
+	lines := []lineIdxs{}
+	for rows.Next() {
+		var (
+			fid    int64
+			strIDs string
+		)
+		if err := rows.Scan(&fid, &strIDs); err != nil {
+			log.Fatalln(err)
+		}
+		lines = append(lines, lineIdxs{fid: fid, idxs: parseOrderIDs(strIDs)})
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	strCols := getColsSql(tblName, db, "from_vertex", "to_vertex")
+	for _, l := range lines {
+		var geomData []byte
+		strSql := fmt.Sprintf("SELECT ST_AsBinary(ST_DissolvePoints(GEOMETRY)) FROM %s WHERE ogc_fid = ?", tblName)
+		if err := db.QueryRow(strSql, l.fid).Scan(&geomData); err != nil {
+			log.Fatalln(err)
+		}
+		geom, err := wkb.Unmarshal(geomData)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		mp := geom.(orb.MultiPoint)
+		pnts := orb.MultiPoint{}
+		for _, idx := range l.idxs {
+			pnts = append(pnts, mp[idx])
+		}
+
+		strSql = fmt.Sprintf("SELECT ST_AsBinary(ST_LinesCutAtNodes(GEOMETRY, GeomFromText(?, %d))) FROM %s WHERE ogc_fid = ?", c.SRID, tblName)
+		if err := db.QueryRow(strSql, wkt.MarshalString(pnts), l.fid).Scan(&geomData); err != nil {
+			log.Fatalln(err)
+		}
+		geom, err = wkb.Unmarshal(geomData)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		ml, ok := geom.(orb.MultiLineString)
+		if !ok {
+			continue
+		}
+
+		for i, piece := range ml {
+			if i == 0 {
+				strSql = fmt.Sprintf("UPDATE %s SET GEOMETRY = GeomFromText(?, %d) WHERE ogc_fid = ?", c.LineLayer, c.SRID)
+			} else {
+				strSql = fmt.Sprintf("INSERT INTO %s (%s, GEOMETRY) SELECT %s, GeomFromText(?, %d) FROM %s WHERE ogc_fid = ?", c.LineLayer, strCols, strCols, c.SRID, tblName)
+			}
+			if _, err := tx.Exec(strSql, wkt.MarshalString(piece), l.fid); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,119 @@
+package osmnode
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/paulmach/orb"
+)
+
+func TestCutLineString(t *testing.T) {
+	tests := []struct {
+		name string
+		line orb.LineString
+		idxs []int
+		want []segment
+	}{
+		{
+			name: "no cut",
+			line: orb.LineString{{0, 0}, {1, 0}, {2, 0}},
+			idxs: nil,
+			want: []segment{{line: orb.LineString{{0, 0}, {1, 0}, {2, 0}}, from: 0, to: 2}},
+		},
+		{
+			name: "middle vertex",
+			line: orb.LineString{{0, 0}, {1, 0}, {2, 0}},
+			idxs: []int{1},
+			want: []segment{
+				{line: orb.LineString{{0, 0}, {1, 0}}, from: 0, to: 1},
+				{line: orb.LineString{{1, 0}, {2, 0}}, from: 1, to: 2},
+			},
+		},
+		{
+			name: "first and last vertex",
+			line: orb.LineString{{0, 0}, {1, 0}, {2, 0}},
+			idxs: []int{0, 2},
+			want: []segment{{line: orb.LineString{{0, 0}, {1, 0}, {2, 0}}, from: 0, to: 2}},
+		},
+		{
+			name: "unsorted and duplicated indexes",
+			line: orb.LineString{{0, 0}, {1, 0}, {2, 0}, {3, 0}},
+			idxs: []int{2, 1, 2},
+			want: []segment{
+				{line: orb.LineString{{0, 0}, {1, 0}}, from: 0, to: 1},
+				{line: orb.LineString{{1, 0}, {2, 0}}, from: 1, to: 2},
+				{line: orb.LineString{{2, 0}, {3, 0}}, from: 2, to: 3},
+			},
+		},
+		{
+			name: "closed ring",
+			line: orb.LineString{{0, 0}, {1, 0}, {1, 1}, {0, 1}, {0, 0}},
+			idxs: []int{0, 2, 4},
+			want: []segment{
+				{line: orb.LineString{{0, 0}, {1, 0}, {1, 1}}, from: 0, to: 2},
+				{line: orb.LineString{{1, 1}, {0, 1}, {0, 0}}, from: 2, to: 4},
+			},
+		},
+		{
+			name: "ring passing the same vertex twice",
+			line: orb.LineString{{0, 0}, {1, 0}, {1, 1}, {1, 0}, {2, 0}},
+			idxs: []int{3},
+			want: []segment{
+				{line: orb.LineString{{0, 0}, {1, 0}, {1, 1}, {1, 0}}, from: 0, to: 3},
+				{line: orb.LineString{{1, 0}, {2, 0}}, from: 3, to: 4},
+			},
+		},
+		{
+			name: "repeated vertices",
+			line: orb.LineString{{0, 0}, {1, 0}, {1, 0}, {2, 0}},
+			idxs: []int{1, 2},
+			want: []segment{
+				{line: orb.LineString{{0, 0}, {1, 0}}, from: 0, to: 1},
+				{line: orb.LineString{{1, 0}, {2, 0}}, from: 2, to: 3},
+			},
+		},
+		{
+			name: "collapsed tail",
+			line: orb.LineString{{0, 0}, {1, 0}, {1, 0}},
+			idxs: []int{1},
+			want: []segment{{line: orb.LineString{{0, 0}, {1, 0}}, from: 0, to: 1}},
+		},
+		{
+			name: "collapsed line is kept whole",
+			line: orb.LineString{{1, 0}, {1, 0}, {1, 0}},
+			idxs: []int{1},
+			want: []segment{{line: orb.LineString{{1, 0}, {1, 0}}, from: 1, to: 2}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cutLineString(tt.line, tt.idxs)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cutLineString() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsCollapsed(t *testing.T) {
+	tests := []struct {
+		name string
+		line orb.LineString
+		want bool
+	}{
+		{"single vertex", orb.LineString{{1, 1}}, true},
+		{"repeated vertex", orb.LineString{{1, 1}, {1, 1}, {1, 1}}, true},
+		{"segment", orb.LineString{{1, 1}, {2, 1}}, false},
+		{"closed ring", orb.LineString{{0, 0}, {1, 0}, {1, 1}, {0, 0}}, false},
+		{"returns to start", orb.LineString{{0, 0}, {0, 0}, {1, 0}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isCollapsed(tt.line); got != tt.want {
+				t.Errorf("isCollapsed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package osmnode
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/paulmach/orb"
+	OAT "navinfo.com/osmsqlitetools/internal/pkg/osmattr"
+)
+
+// SplitLayer selects the features of a layer at which the lines are split, the
+// features where Field is not NULL or, with Value, equal to Value. A Field
+// which is not a column of the layer is looked up in other_tags.
+type SplitLayer struct {
+	Layer string
+	Field string
+	Value string
+}
+
+func (s SplitLayer) where(db *sql.DB) string {
+	if OAT.IsColExist(s.Layer, s.Field, db) {
+		if len(s.Value) == 0 {
+			return fmt.Sprintf("%s IS NOT NULL", s.Field)
+		}
+		return fmt.Sprintf("%s = '%s'", s.Field, s.Value)
+	}
+
+	if len(s.Value) == 0 {
+		return fmt.Sprintf(`other_tags LIKE '%%"%s"=>%%'`, s.Field)
+	}
+	return fmt.Sprintf(`other_tags LIKE '%%"%s"=>"%s"%%'`, s.Field, s.Value)
+}
+
+func (c LinesSplitConfig) pointLinkLayer() string {
+	if len(c.PointLinkLayer) > 0 {
+		return c.PointLinkLayer
+	}
+	return fmt.Sprintf("%s_points", c.NodeLayer)
+}
+
+// addSplitPoints marks the vertices of the lines lying on a point of the split
+// layers as intersections, so the lines are also cut there.
+func addSplitPoints(c LinesSplitConfig, db *sql.DB) {
+	for _, s := range c.SplitLayers {
+		strSql := fmt.Sprintf("UPDATE %s SET intersections = intersections + 1 WHERE GEOMETRY IN (SELECT %s FROM %s WHERE %s)", c.LineNodeLayer, geomCol(s.Layer, "GEOMETRY", c.SRID, db), s.Layer, s.where(db))
+		_, err := db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// linkSplitPoints links the nodes to the points of the split layers at the
+// same location, the attributes of a point being found in its layer by
+// point_fid.
+func linkSplitPoints(c LinesSplitConfig, db *sql.DB) {
+	if len(c.SplitLayers) == 0 {
+		return
+	}
+
+	tblName := c.pointLinkLayer()
+	strSql := fmt.Sprintf("DROP TABLE IF EXISTS %s", tblName)
+	_, err := db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	strSql = fmt.Sprintf("CREATE TABLE %s (ogc_fid INTEGER PRIMARY KEY AUTOINCREMENT, node_fid INTEGER, layer VARCHAR, point_fid INTEGER, osm_id BIGINT)", tblName)
+	_, err = db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	linked := map[string]bool{}
+	for _, s := range c.SplitLayers {
+		strWhere := s.where(db)
+		// Several split layers can select the same point.
+		key := s.Layer + " " + strWhere
+		if linked[key] {
+			continue
+		}
+		linked[key] = true
+
+		strSql = fmt.Sprintf(`INSERT INTO %s (node_fid, layer, point_fid, osm_id)
+			SELECT n.ogc_fid, '%s', p.ogc_fid, p.osm_id FROM %s AS p JOIN %s AS n ON n.GEOMETRY = %s
+			WHERE %s AND p.ogc_fid NOT IN (SELECT point_fid FROM %s WHERE layer = '%s')`,
+			tblName, s.Layer, s.Layer, c.NodeLayer, geomCol(s.Layer, "p.GEOMETRY", c.SRID, db), strWhere, tblName, s.Layer)
+		_, err = db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	strSql = fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_node_fid ON %s (node_fid)", tblName, tblName)
+	_, err = db.Exec(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// loadSplitPoints returns the locations of the points of the split layers.
+func loadSplitPoints(c LinesSplitConfig, db *sql.DB) map[orb.Point]bool {
+	pnts := make(map[orb.Point]bool)
+	for _, s := range c.SplitLayers {
+		strGeom := geomCol(s.Layer, "GEOMETRY", c.SRID, db)
+		strSql := fmt.Sprintf("SELECT ST_X(%s), ST_Y(%s) FROM %s WHERE GEOMETRY IS NOT NULL AND %s", strGeom, strGeom, s.Layer, s.where(db))
+		rows, err := db.Query(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		for rows.Next() {
+			var p orb.Point
+			if err := rows.Scan(&p[0], &p[1]); err != nil {
+				log.Fatalln(err)
+			}
+			pnts[p] = true
+		}
+		if err := rows.Err(); err != nil {
+			log.Fatalln(err)
+		}
+		rows.Close()
+	}
+
+	return pnts
+}
@@ -0,0 +1,163 @@
+package osmnode
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/planar"
+	OAT "navinfo.com/osmsqlitetools/internal/pkg/osmattr"
+	OGM "navinfo.com/osmsqlitetools/internal/pkg/osmgeom"
+)
+
+const defaultSRID = 4326
+
+// resolveSRID sets the SRID of the config from the line layer when it is not
+// configured. When Transform is set, the line layer is replaced by its copy
+// reprojected to that SRID, an incremental run reusing the existing copy and
+// syncing the changed lines into it.
+func resolveSRID(c *LinesSplitConfig, db *sql.DB) {
+	if c.SRID == 0 {
+		c.SRID = OGM.LayerSRID(c.LineLayer, db)
+	}
+	if c.SRID == 0 {
+		c.SRID = defaultSRID
+	}
+
+	if c.Transform > 0 && c.Transform != c.SRID {
+		checkMetricSRID(c.Transform, db)
+
+		dstName := c.TransformLayer
+		if len(dstName) == 0 {
+			dstName = fmt.Sprintf("%s_%d", c.LineLayer, c.Transform)
+		}
+		if c.Mode != "incremental" || !OAT.IsTblExist(dstName, db) {
+			transformLayer(c.LineLayer, dstName, c.Transform, db)
+		}
+		// The network keeps the name of the imported layer.
+		if len(c.Network) == 0 {
+			c.Network = c.LineLayer
+		}
+		c.sourceLayer = c.LineLayer
+		c.LineLayer = dstName
+		c.SRID = c.Transform
+	}
+}
+
+// checkMetricSRID stops when the lengths in srid are not in metres. A Mercator
+// SRID such as 3857 is in metres only at the equator, so it is warned about.
+func checkMetricSRID(srid int, db *sql.DB) {
+	var proj4 string
+	row := db.QueryRow("SELECT proj4text FROM spatial_ref_sys WHERE srid = ?", srid)
+	err := row.Scan(&proj4)
+	if err == sql.ErrNoRows {
+		log.Fatalf("SRID %d is not in spatial_ref_sys", srid)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	params := strings.Fields(proj4)
+	switch {
+	case slices.Contains(params, "+proj=longlat"):
+		return
+	case !slices.Contains(params, "+units=m"):
+		log.Fatalf("SRID %d is not in metres, transform to a metric SRID such as a UTM zone", srid)
+	case slices.Contains(params, "+proj=merc"):
+		log.Printf("SRID %d is a Mercator projection, its lengths and maxlength are scaled by 1/cos(latitude) and are not ground metres", srid)
+	}
+}
+
+// transformLayer copies the layer to dstName with its GEOMETRY reprojected to
+// srid, with a spatial index. The copy keeps the geometry type but is XY, as the
+// split lines and nodes are written in 2D.
+func transformLayer(tblName string, dstName string, srid int, db *sql.DB) {
+	log.Printf("Start transform %s to %s in SRID %d", tblName, dstName, srid)
+
+	geomType := OGM.LayerGeometryType(tblName, db)
+	if geomType == 0 {
+		log.Fatalf("%s is not registered in geometry_columns", tblName)
+	}
+
+	strSqls := []string{}
+	if OAT.IsTblExist(dstName, db) {
+		strSqls = append(strSqls,
+			fmt.Sprintf("SELECT DisableSpatialIndex('%s', 'GEOMETRY')", dstName),
+			fmt.Sprintf("DROP TABLE IF EXISTS idx_%s_GEOMETRY", dstName),
+			fmt.Sprintf("SELECT DiscardGeometryColumn('%s', 'GEOMETRY')", dstName),
+			fmt.Sprintf("DROP TABLE %s", dstName),
+		)
+	}
+	strCols := getColsSql(tblName, db)
+	strSqls = append(strSqls,
+		fmt.Sprintf("CREATE TABLE %s (ogc_fid INTEGER PRIMARY KEY AUTOINCREMENT, %s)", dstName, getColDefsSql(tblName, db)),
+		fmt.Sprintf("SELECT AddGeometryColumn('%s', 'GEOMETRY', %d, '%s', '%s')", dstName, srid, OGM.GeometryTypes[geomType%1000], "XY"),
+		fmt.Sprintf("INSERT INTO %s (ogc_fid, %s, GEOMETRY) SELECT ogc_fid, %s, ST_Force2D(ST_Transform(GEOMETRY, %d)) FROM %s", dstName, strCols, strCols, srid, tblName),
+		fmt.Sprintf("SELECT CreateSpatialIndex('%s', 'GEOMETRY')", dstName),
+	)
+	for _, strSql := range strSqls {
+		_, err := db.Exec(strSql)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	log.Printf("Finished transform %s to %s in SRID %d", tblName, dstName, srid)
+}
+
+// getColDefsSql returns the definitions of the columns of the table, without
+// ogc_fid and GEOMETRY.
+func getColDefsSql(tblName string, db *sql.DB) string {
+	strSql := fmt.Sprintf("SELECT name, type FROM pragma_table_info('%s')", tblName)
+	rows, err := db.Query(strSql)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	defs := []string{}
+	for rows.Next() {
+		var strCol, strType string
+		if err := rows.Scan(&strCol, &strType); err != nil {
+			log.Fatalln(err)
+		}
+		if strCol == "ogc_fid" || strCol == "GEOMETRY" {
+			continue
+		}
+		defs = append(defs, strings.TrimSpace(strCol+" "+strType))
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	return strings.Join(defs, ", ")
+}
+
+// geomCol returns the expression of the GEOMETRY column col of the layer in
+// srid, transformed when the layer is registered in another SRID.
+func geomCol(tblName string, col string, srid int, db *sql.DB) string {
+	if layerSrid := OGM.LayerSRID(tblName, db); layerSrid != 0 && layerSrid != srid {
+		return fmt.Sprintf("ST_Transform(%s, %d)", col, srid)
+	}
+	return col
+}
+
+// distanceFunc returns the distance in metres between two points in srid,
+// geodesic for a geographic SRID and planar otherwise.
+func distanceFunc(srid int, db *sql.DB) func(orb.Point, orb.Point) float64 {
+	var geographic int
+	row := db.QueryRow("SELECT SridIsGeographic(?)", srid)
+	err := row.Scan(&geographic)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if geographic == 1 {
+		return geo.Distance
+	}
+	return planar.Distance
+}
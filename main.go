@@ -10,19 +10,27 @@ import (
 
 	"github.com/mattn/go-sqlite3"
 	OAT "navinfo.com/osmsqlitetools/internal/pkg/osmattr"
+	OEX "navinfo.com/osmsqlitetools/internal/pkg/osmexport"
+	OIM "navinfo.com/osmsqlitetools/internal/pkg/osmimport"
 	OL2T "navinfo.com/osmsqlitetools/internal/pkg/osmnode"
 )
 
 // First to convert osm to spatialite
 // ogr2ogr -f SQLite route.sqlite route.osm -progress -dsco SPATIALITE=YES
-// go run main.go -f "./samples/route1.sqlite" -t "./tags.yml" -e "./lines_extract.yml" -s "./lines_split.yml"
+// or import it with -i "./import.yml"
+// go run main.go -f "./samples/route1.sqlite" -t "./tags.yml" -e "./lines_extract.yml" -s "./lines_split.yml" -c "./components.yml" -r "./restrictions.yml" -o "./export.yml" -m "./tiles.yml"
 
 var (
 	showUsage          bool
 	strPathName        string
+	strImpConfPathName string
 	strTagConfPathName string
 	strExtConfPathName string
 	strSptConfPathName string
+	strCmpConfPathName string
+	strRstConfPathName string
+	strExpConfPathName string
+	strTilConfPathName string
 )
 
 func usage() {
@@ -37,9 +45,14 @@ Options:
 func init() {
 	flag.BoolVar(&showUsage, "h", false, "Show help.")
 	flag.StringVar(&strPathName, "f", "", "Set spatialite file name.")
+	flag.StringVar(&strImpConfPathName, "i", "", "Import osm file config file name.")
 	flag.StringVar(&strTagConfPathName, "t", "", "Set tag extract config file name.")
 	flag.StringVar(&strExtConfPathName, "e", "", "Set lines extract config file name.")
 	flag.StringVar(&strSptConfPathName, "s", "", "Split lines at intersection config file name.")
+	flag.StringVar(&strCmpConfPathName, "c", "", "Connected component analysis config file name.")
+	flag.StringVar(&strRstConfPathName, "r", "", "Turn restriction extract config file name.")
+	flag.StringVar(&strExpConfPathName, "o", "", "Export layers config file name.")
+	flag.StringVar(&strTilConfPathName, "m", "", "Vector tiles to MBTiles config file name.")
 
 	flag.Usage = usage
 }
@@ -71,6 +84,10 @@ func main() {
 	defer db.Close()
 	db.SetMaxOpenConns(16)
 
+	if len(strImpConfPathName) > 0 {
+		OIM.Import(strImpConfPathName, db)
+	}
+
 	if len(strExtConfPathName) > 0 {
 		OAT.ExtractLines(strExtConfPathName, db)
 	}
@@ -89,4 +106,20 @@ func main() {
 	if len(strSptConfPathName) > 0 {
 		OL2T.SplitLines(strSptConfPathName, db)
 	}
+
+	if len(strCmpConfPathName) > 0 {
+		OL2T.AnalyzeComponents(strCmpConfPathName, db)
+	}
+
+	if len(strRstConfPathName) > 0 {
+		OL2T.ExtractRestrictions(strRstConfPathName, db)
+	}
+
+	if len(strExpConfPathName) > 0 {
+		OEX.Export(strExpConfPathName, db)
+	}
+
+	if len(strTilConfPathName) > 0 {
+		OEX.GenerateTiles(strTilConfPathName, db)
+	}
 }